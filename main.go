@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"flag"
-	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -14,6 +16,8 @@ import (
 	"logbay/common"
 	"logbay/digest"
 	"logbay/ingest"
+	"logbay/metrics"
+	"logbay/router"
 )
 
 var log = common.ContextLogger(context.WithValue(context.Background(), "prefix", "main"))
@@ -26,17 +30,81 @@ func main() {
 	config, err := loadConfig(confPath)
 
 	if err != nil {
-		log.Errorf("Can not load config file at %s. Err: %s", confPath, err.Error())
+		log.Errorf("Can not load config file at %s. Err: %s", *confPath, err.Error())
 		os.Exit(1)
 	}
 
 	prepareLogger(config.LogConfig)
-	prepareIngests(config.IngestPoints)
-	consumers := prepareDigests(config.DigestPoints)
 
-	dispatch(consumers)
+	if config.Metrics.Port > 0 {
+		server := metrics.NewServer(config.Metrics)
 
-	<-make(chan byte)
+		if err := server.Start(); err != nil {
+			log.Errorf("Failed to start metrics server. Err: %s", err.Error())
+		} else {
+			defer server.Stop(context.Background())
+		}
+	}
+
+	ingests := prepareIngests(config.IngestPoints)
+	digests, routes := prepareDigests(config.DigestPoints)
+
+	r := router.New()
+
+	for name, d := range digests {
+		r.AddConsumer(name, d, config.DigestPoints[name].Queue)
+	}
+
+	for ingestName, consumers := range routes {
+		if messenger, ok := ingest.GetIngestPoint(ingestName); ok {
+			r.Route(messenger, consumers)
+		}
+	}
+
+	timeout := config.ShutdownTimeout.Duration
+
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	// digest which failed to start would swallow messages routed to it, so startup fails as a whole
+	if started, ok := start(ingests, digests); !ok {
+		shutdown(timeout, ingests, started, config.DigestPoints, r)
+		os.Exit(1)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	log.Infof("Received %s. Shutting down", sig)
+
+	shutdown(timeout, ingests, digests, config.DigestPoints, r)
+}
+
+// start starts digests and then ingests. once any of them fails, the rest is not started and false
+// is returned along with digests started so far. ingests are safe to stop whether started or not
+func start(ingests map[string]common.Messenger, digests map[string]common.Consumer) (map[string]common.Consumer, bool) {
+
+	started := make(map[string]common.Consumer)
+
+	for name, d := range digests {
+		if err := d.Start(); err != nil {
+			log.Errorf("Failed to start digest point %s. Err: %s", name, err.Error())
+			return started, false
+		}
+
+		started[name] = d
+	}
+
+	for name, i := range ingests {
+		if err := i.Start(); err != nil {
+			log.Errorf("Failed to start ingest point %s. Err: %s", name, err.Error())
+			return started, false
+		}
+	}
+
+	return started, true
 }
 
 func loadConfig(p *string) (*common.AppConfig, error) {
@@ -45,7 +113,9 @@ func loadConfig(p *string) (*common.AppConfig, error) {
 	return config, err
 }
 
-func prepareIngests(ingests map[string]common.PointConfig) {
+func prepareIngests(ingests map[string]common.PointConfig) map[string]common.Messenger {
+
+	points := make(map[string]common.Messenger)
 
 	for k, v := range ingests {
 
@@ -54,18 +124,24 @@ func prepareIngests(ingests map[string]common.PointConfig) {
 		}
 
 		v.Name = k
-		_, err := ingest.NewIngestPoint(v)
+		point, err := ingest.NewIngestPoint(v)
 
 		if err != nil {
 			logrus.Errorf("Failed to create ingest point. Err: %s", err.Error())
 			continue
 		}
+
+		points[k] = point
 	}
+
+	return points
 }
 
-func prepareDigests(conf map[string]common.PointConfig) map[string][]common.Consumer {
+// prepareDigests returns created digests by name and names of digests consuming from each ingest
+func prepareDigests(conf map[string]common.PointConfig) (map[string]common.Consumer, map[string][]string) {
 
-	consumers := make(map[string][]common.Consumer)
+	digests := make(map[string]common.Consumer)
+	consumers := make(map[string][]string)
 
 	for name, pointConfig := range conf {
 
@@ -82,6 +158,8 @@ func prepareDigests(conf map[string]common.PointConfig) map[string][]common.Cons
 			continue
 		}
 
+		digests[name] = consumer
+
 		// check ingest points
 		for _, ingestName := range pointConfig.Ingests {
 			if _, ok := ingest.GetIngestPoint(ingestName); !ok {
@@ -89,12 +167,12 @@ func prepareDigests(conf map[string]common.PointConfig) map[string][]common.Cons
 				continue
 			} else {
 				log.Debugf("%s consuming from %s", name, ingestName)
-				consumers[ingestName] = append(consumers[ingestName], consumer)
+				consumers[ingestName] = append(consumers[ingestName], name)
 			}
 		}
 	}
 
-	return consumers
+	return digests, consumers
 }
 
 func prepareLogger(config common.LogConfig) {
@@ -102,7 +180,7 @@ func prepareLogger(config common.LogConfig) {
 	// set log level
 	if level := config.Level; len(level) > 0 {
 		if level, err := logrus.ParseLevel(level); err != nil {
-			log.Errorf("%s is not valid config level. Must be ne of: DEBUG, INFO. WARN, ERROR, FATAL")
+			log.Errorf("%s is not valid config level. Must be one of: DEBUG, INFO. WARN, ERROR, FATAL", config.Level)
 		} else {
 			logrus.SetLevel(level)
 		}
@@ -138,43 +216,94 @@ func prepareLogger(config common.LogConfig) {
 
 func rotateLog(logfile string) (*os.File, error) {
 
-	f, err := os.OpenFile(logfile, os.O_WRONLY, os.ModePerm)
-	defer f.Close()
-
-	if err == nil {
-		old := fmt.Sprintf("%s.%s", logfile, time.Now().Format("20060102-150405"))
-		err = os.Rename(f.Name(), old)
-
-		if err != nil {
-			return nil, err
-		}
+	if _, err := common.RotateFile(logfile); err != nil {
+		return nil, err
 	}
 
 	return os.Create(logfile)
 }
 
-func dispatch(mapping map[string][]common.Consumer) {
+// shutdown stops ingests first so router can drain buffered messages, then stops digests
+// to let them flush whatever they hold. ingests acknowledging messages to their source finish once
+// digests settled them. everything must be done within timeout
+func shutdown(timeout time.Duration, ingests map[string]common.Messenger, digests map[string]common.Consumer, digestConf map[string]common.PointConfig, r *router.Router) {
 
-	for ingestName, consumers := range mapping {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-		messenger, ok := ingest.GetIngestPoint(ingestName)
+	stopAll := func(points map[string]common.Lifecycle) {
+		wg := sync.WaitGroup{}
 
-		if !ok {
-			continue
+		for name, point := range points {
+			wg.Add(1)
+			go func(name string, point common.Lifecycle) {
+				defer wg.Done()
+				if err := point.Stop(ctx); err != nil {
+					log.Errorf("Failed to stop %s. Err: %s", name, err.Error())
+				}
+			}(name, point)
 		}
 
-		go func(m common.Messenger, consumers []common.Consumer) {
-			for {
-				select {
-				case msg := <-messenger.Messages():
-					for _, consumer := range consumers {
-						consumer.Consume(msg)
-					}
-				default:
-					time.Sleep(100 * time.Millisecond)
+		wg.Wait()
+	}
+
+	points := make(map[string]common.Lifecycle)
+
+	for name, i := range ingests {
+		points[name] = i
+	}
+
+	stopAll(points)
+
+	finishAll := func() {
+		for name, i := range ingests {
+			if a, ok := i.(common.Acknowledger); ok {
+				if err := a.Finish(ctx); err != nil {
+					log.Errorf("Failed to acknowledge messages of %s. Err: %s", name, err.Error())
 				}
 			}
-		}(messenger, consumers)
+		}
+	}
 
+	if err := r.Drain(ctx); err != nil {
+		// digests can't be stopped while router is still consuming into them
+		log.Errorf("Buffered messages are not delivered. Err: %s", err.Error())
+		finishAll()
+		return
 	}
+
+	// dead-letter destination is stopped only once every digest passing dead letters to it is stopped,
+	// so records rejected during final flush reach it. chains are stopped from the first digest to the last
+	remaining := make(map[string]common.Lifecycle)
+
+	for name, d := range digests {
+		remaining[name] = d
+	}
+
+	for len(remaining) > 0 {
+		points = make(map[string]common.Lifecycle)
+
+		for name, d := range remaining {
+			points[name] = d
+		}
+
+		for name := range remaining {
+			delete(points, digestConf[name].DeadLetter)
+		}
+
+		// loops are rejected by elastic digest, but nothing should be left running anyway
+		if len(points) == 0 {
+			points = remaining
+		}
+
+		stopAll(points)
+
+		for name := range points {
+			delete(remaining, name)
+		}
+	}
+
+	finishAll()
+
+	log.Infoln("Shutdown complete")
 }
@@ -0,0 +1,225 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	certCheckInterval  = 30 * time.Second
+	certExpiryWarning  = 14 * 24 * time.Hour
+	certExpiryReminder = 24 * time.Hour
+)
+
+// CertReloader serves certificate and client CA pool and reloads them when files change or on SIGHUP.
+// connections in progress keep certificate they were established with
+type CertReloader struct {
+	certPath      string
+	keyPath       string
+	caPath        string
+	verifyClients bool
+	mu            sync.RWMutex
+	cert          *tls.Certificate
+	pool          *x509.CertPool
+	stamps        map[string]string
+	warnedAt      time.Time
+	stop          chan struct{}
+	done          chan struct{}
+}
+
+func newCertReloader(certPath, keyPath, caPath string, verifyClients bool) (*CertReloader, error) {
+
+	r := &CertReloader{
+		certPath:      certPath,
+		keyPath:       keyPath,
+		caPath:        caPath,
+		verifyClients: verifyClients,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// configure makes config take certificate and client CA pool from reloader on every handshake
+func (r *CertReloader) configure(config *tls.Config) {
+
+	config.Certificates = nil
+	config.GetCertificate = r.getCertificate
+
+	if !r.verifyClients {
+		return
+	}
+
+	config.ClientCAs = r.clientCAs()
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := config.Clone()
+		c.ClientCAs = r.clientCAs()
+		c.GetConfigForClient = nil
+		return c, nil
+	}
+}
+
+func (r *CertReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *CertReloader) clientCAs() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pool
+}
+
+// load reads certificate, key and CA. currently served ones are kept if any of files is invalid
+func (r *CertReloader) load() error {
+
+	stamps := r.stat()
+
+	cert, err := LoadCertificate(r.certPath, r.keyPath, r.caPath)
+
+	if err != nil {
+		return err
+	}
+
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+
+	if r.verifyClients {
+		if pool, err = loadCertPool(r.caPath); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.pool = pool
+	r.stamps = stamps
+	r.warnedAt = time.Time{}
+	r.mu.Unlock()
+
+	r.checkExpiry()
+
+	return nil
+}
+
+// Watch reloads certificates when files are modified or SIGHUP is received
+func (r *CertReloader) Watch() {
+
+	log := ContextLogger(context.WithValue(context.Background(), "prefix", "tls"))
+
+	defer close(r.done)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-signals:
+			log.Infof("SIGHUP received. Reloading %s", r.certPath)
+		case <-ticker.C:
+			if !r.changed() {
+				r.checkExpiry()
+				continue
+			}
+			log.Infof("Certificate files changed. Reloading %s", r.certPath)
+		case <-r.stop:
+			return
+		}
+
+		if err := r.load(); err != nil {
+			log.Errorf("Can't reload certificate. Keep serving the previous one. Err: %s", err.Error())
+			continue
+		}
+
+		cert, _ := r.getCertificate(nil)
+		log.Infof("Certificate reloaded. Expires at %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// Close stops Watch
+func (r *CertReloader) Close() {
+	close(r.stop)
+	<-r.done
+}
+
+// stat returns modification time and size of every file. files which can't be read are skipped
+func (r *CertReloader) stat() map[string]string {
+
+	stamps := make(map[string]string)
+
+	for _, path := range []string{r.certPath, r.keyPath, r.caPath} {
+		if len(path) == 0 {
+			continue
+		}
+
+		if info, err := os.Stat(path); err == nil {
+			stamps[path] = fmt.Sprintf("%d:%d", info.ModTime().UnixNano(), info.Size())
+		}
+	}
+
+	return stamps
+}
+
+func (r *CertReloader) changed() bool {
+
+	stamps := r.stat()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(stamps) != len(r.stamps) {
+		return true
+	}
+
+	for path, stamp := range stamps {
+		if r.stamps[path] != stamp {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkExpiry warns once a day about certificate expiring soon
+func (r *CertReloader) checkExpiry() {
+
+	log := ContextLogger(context.WithValue(context.Background(), "prefix", "tls"))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	left := time.Until(r.cert.Leaf.NotAfter)
+
+	if left > certExpiryWarning || time.Since(r.warnedAt) < certExpiryReminder {
+		return
+	}
+
+	r.warnedAt = time.Now()
+
+	if left <= 0 {
+		log.Errorf("Certificate %s expired at %s", r.certPath, r.cert.Leaf.NotAfter.Format(time.RFC3339))
+		return
+	}
+
+	log.Warnf("Certificate %s expires in %s", r.certPath, left.Round(time.Minute))
+}
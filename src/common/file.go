@@ -0,0 +1,34 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// RotateFile renames existing file to <name>.<timestamp> and returns the new name.
+// Empty name is returned if there is no file to rotate
+func RotateFile(name string) (string, error) {
+
+	if _, err := os.Stat(name); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	timestamp := time.Now().Format("20060102-150405")
+	rotated := fmt.Sprintf("%s.%s", name, timestamp)
+
+	// several rotations within a second must not overwrite each other or their compressed copies
+	for i := 1; exists(rotated) || exists(rotated+".gz"); i++ {
+		rotated = fmt.Sprintf("%s.%s.%d", name, timestamp, i)
+	}
+
+	return rotated, os.Rename(name, rotated)
+}
+
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return !os.IsNotExist(err)
+}
@@ -0,0 +1,24 @@
+package common
+
+import (
+	"context"
+	"sync"
+)
+
+// WaitContext waits for wg to be done or returns ctx error if ctx is done first
+func WaitContext(ctx context.Context, wg *sync.WaitGroup) error {
+
+	done := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
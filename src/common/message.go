@@ -0,0 +1,70 @@
+package common
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Message is passed from ingest points to digest points. Ingest and Seq are assigned by ingest point
+// once message is accepted into its buffer
+type Message struct {
+	Payload    []byte            `json:"payload"`
+	Ingest     string            `json:"ingest"`
+	ReceivedAt time.Time         `json:"receivedAt"`
+	Remote     string            `json:"remote,omitempty"`
+	Seq        uint64            `json:"seq"`
+	Meta       map[string]string `json:"meta,omitempty"`
+
+	settle  func(ok bool)
+	pending int32
+	failed  int32
+	settled int32
+}
+
+func NewMessage(payload []byte, remote string) *Message {
+	return &Message{
+		Payload:    payload,
+		ReceivedAt: time.Now().UTC(),
+		Remote:     remote,
+	}
+}
+
+func (m *Message) String() string {
+	return string(m.Payload)
+}
+
+// OnSettle sets fn to be called once message delivery is finished. ok is true only if every digest
+// message is routed to accepted it. used by ingest points acknowledging messages to their source
+func (m *Message) OnSettle(fn func(ok bool)) {
+	m.settle = fn
+}
+
+// Hold registers n deliveries of message. message with no deliveries is settled right away
+func (m *Message) Hold(n int) {
+
+	if n == 0 {
+		m.Settle(true)
+		return
+	}
+
+	atomic.AddInt32(&m.pending, int32(n))
+}
+
+// Release finishes one delivery registered with Hold. message is settled once all of them are finished
+func (m *Message) Release(ok bool) {
+
+	if !ok {
+		atomic.StoreInt32(&m.failed, 1)
+	}
+
+	if atomic.AddInt32(&m.pending, -1) == 0 {
+		m.Settle(atomic.LoadInt32(&m.failed) == 0)
+	}
+}
+
+// Settle finishes message delivery regardless of pending ones. only the first call has effect
+func (m *Message) Settle(ok bool) {
+	if m.settle != nil && atomic.CompareAndSwapInt32(&m.settled, 0, 1) {
+		m.settle(ok)
+	}
+}
@@ -0,0 +1,92 @@
+package common
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/go-redis/redis"
+)
+
+// RedisConfig describes connection shared by redis ingest and digest points
+type RedisConfig struct {
+	Addrs              []string `toml:"Addrs,omitempty"`
+	MasterName         string   `toml:"MasterName,omitempty"`
+	Cluster            bool     `toml:"Cluster,omitempty"`
+	Password           string   `toml:"Password,omitempty"`
+	DB                 int      `toml:"DB,omitempty"`
+	TLS                bool     `toml:"TLS,omitempty"`
+	CA                 string   `toml:"CA,omitempty"`
+	Certificate        string   `toml:"Certificate,omitempty"`
+	Key                string   `toml:"Key,omitempty"`
+	InsecureSkipVerify bool     `toml:"InsecureSkipVerify,omitempty"`
+	DialTimeout        Duration `toml:"DialTimeout,omitempty"`
+	ReadTimeout        Duration `toml:"ReadTimeout,omitempty"`
+	WriteTimeout       Duration `toml:"WriteTimeout,omitempty"`
+	PoolSize           int      `toml:"PoolSize,omitempty"`
+}
+
+// NewRedisClient connects to sentinel-managed master if MasterName is set, to cluster if Cluster is set
+// and to single server otherwise. host and port are used when Addrs is empty
+func NewRedisClient(host string, port int, conf RedisConfig) (redis.UniversalClient, error) {
+
+	addrs := conf.Addrs
+
+	if len(addrs) == 0 {
+		addrs = []string{fmt.Sprintf("%s:%d", host, port)}
+	}
+
+	password, err := ResolveSecret(conf.Password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.Cluster && conf.DB != 0 {
+		return nil, errors.New("DB can't be selected in cluster mode")
+	}
+
+	var config *tls.Config
+
+	if conf.TLS {
+		if config, err = ClientTLSConfig(conf.CA, conf.Certificate, conf.Key, conf.InsecureSkipVerify); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case len(conf.MasterName) > 0:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    conf.MasterName,
+			SentinelAddrs: addrs,
+			Password:      password,
+			DB:            conf.DB,
+			DialTimeout:   conf.DialTimeout.Duration,
+			ReadTimeout:   conf.ReadTimeout.Duration,
+			WriteTimeout:  conf.WriteTimeout.Duration,
+			PoolSize:      conf.PoolSize,
+			TLSConfig:     config,
+		}), nil
+	case conf.Cluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        addrs,
+			Password:     password,
+			DialTimeout:  conf.DialTimeout.Duration,
+			ReadTimeout:  conf.ReadTimeout.Duration,
+			WriteTimeout: conf.WriteTimeout.Duration,
+			PoolSize:     conf.PoolSize,
+			TLSConfig:    config,
+		}), nil
+	}
+
+	return redis.NewClient(&redis.Options{
+		Addr:         addrs[0],
+		Password:     password,
+		DB:           conf.DB,
+		DialTimeout:  conf.DialTimeout.Duration,
+		ReadTimeout:  conf.ReadTimeout.Duration,
+		WriteTimeout: conf.WriteTimeout.Duration,
+		PoolSize:     conf.PoolSize,
+		TLSConfig:    config,
+	}), nil
+}
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ResolveSecret returns config value as is unless it refers to environment variable ("env:NAME")
+// or file ("file:/path/to/secret"), in which case referred value is returned
+func ResolveSecret(value string) (string, error) {
+
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		secret, ok := os.LookupEnv(name)
+
+		if !ok {
+			return "", errors.New(fmt.Sprintf("environment variable %s is not set", name))
+		}
+
+		return secret, nil
+	case strings.HasPrefix(value, "file:"):
+		b, err := ioutil.ReadFile(strings.TrimPrefix(value, "file:"))
+
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimSpace(string(b)), nil
+	}
+
+	return value, nil
+}
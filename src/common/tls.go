@@ -0,0 +1,244 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// ClientTLSConfig builds TLS config for outgoing connections. CA replaces system roots if set,
+// certificate and key are presented to server if both are set
+func ClientTLSConfig(ca, cert, key string, insecure bool) (*tls.Config, error) {
+
+	config := &tls.Config{
+		InsecureSkipVerify: insecure,
+	}
+
+	if len(ca) > 0 {
+		pem, err := ioutil.ReadFile(ca)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New(fmt.Sprintf("no certificates found in %s", ca))
+		}
+
+		config.RootCAs = pool
+	}
+
+	if len(cert) > 0 || len(key) > 0 {
+		keypair, err := tls.LoadX509KeyPair(cert, key)
+
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{keypair}
+	}
+
+	return config, nil
+}
+
+// ServerTLSConfig describes certificate of TLS server and how clients are authenticated
+type ServerTLSConfig struct {
+	Cert       string
+	Key        string
+	CA         string
+	ClientAuth ClientAuth
+	AllowedCN  []string
+	AllowedSAN []string
+}
+
+// ServerTLS builds config of TLS server which takes certificate from returned reloader
+func ServerTLS(conf *ServerTLSConfig) (*tls.Config, *CertReloader, error) {
+
+	log := ContextLogger(context.WithValue(context.Background(), "prefix", "tls"))
+
+	if len(conf.Cert) == 0 || len(conf.Key) == 0 {
+		log.Warnf("Invalid certificate or key path. Cert: %s. Key: %s", conf.Cert, conf.Key)
+		return nil, nil, errors.New("invalid certificate or key path")
+	}
+
+	config := &tls.Config{}
+	config.Rand = rand.Reader
+
+	if err := clientAuth(config, conf); err != nil {
+		return nil, nil, err
+	}
+
+	certs, err := newCertReloader(conf.Cert, conf.Key, conf.CA, config.ClientAuth != tls.NoClientCert)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certs.configure(config)
+
+	return config, certs, nil
+}
+
+// clientAuth makes config ask clients for certificates. pool of CAs to verify them with is set by CertReloader
+func clientAuth(config *tls.Config, conf *ServerTLSConfig) error {
+
+	switch conf.ClientAuth {
+	case "", ClientAuthNone:
+		if len(conf.AllowedCN) > 0 || len(conf.AllowedSAN) > 0 {
+			return errors.New("AllowedCN and AllowedSAN require ClientAuth")
+		}
+		return nil
+	case ClientAuthRequest:
+		// certificate is optional, but it is verified once presented
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequireAndVerify:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return errors.New(fmt.Sprintf("invalid client auth %s", conf.ClientAuth))
+	}
+
+	if len(conf.CA) == 0 {
+		return errors.New("CA is required to verify client certificates")
+	}
+
+	return nil
+}
+
+// LoadCertificate loads server keypair and appends certificates found in CA file (if any) to the chain
+func LoadCertificate(certPath, keyPath, caPath string) (tls.Certificate, error) {
+
+	log := ContextLogger(context.WithValue(context.Background(), "prefix", "tls"))
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+
+	if err != nil {
+		log.Errorf("Failed to load keypair. Err: %s", err.Error())
+		return cert, err
+	}
+
+	if len(caPath) == 0 {
+		return cert, nil
+	}
+
+	ca, err := ioutil.ReadFile(caPath)
+
+	if err != nil {
+		log.Errorf("failed to read certificate authority chain. Err: %s", err.Error())
+		return cert, err
+	}
+
+	var der *pem.Block
+	rest := []byte(ca)
+
+	duplicate := func(b []byte) bool {
+		for _, data := range cert.Certificate {
+			if bytes.Equal(data, b) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for {
+		der, rest = pem.Decode(rest)
+		if der == nil {
+			break
+		}
+		if der.Type != "CERTIFICATE" {
+			continue
+		}
+		if duplicate(der.Bytes) {
+			continue
+		}
+		cert.Certificate = append(cert.Certificate, der.Bytes)
+	}
+
+	return cert, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+
+	ca, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New(fmt.Sprintf("no certificates found in %s", path))
+	}
+
+	return pool, nil
+}
+
+// AllowList permits client certificates by subject common name or any of subject alternative names
+type AllowList struct {
+	cn  map[string]struct{}
+	san map[string]struct{}
+}
+
+func NewAllowList(cn, san []string) *AllowList {
+
+	if len(cn) == 0 && len(san) == 0 {
+		return nil
+	}
+
+	a := &AllowList{
+		cn:  make(map[string]struct{}, len(cn)),
+		san: make(map[string]struct{}, len(san)),
+	}
+
+	for _, v := range cn {
+		a.cn[v] = struct{}{}
+	}
+
+	for _, v := range san {
+		a.san[v] = struct{}{}
+	}
+
+	return a
+}
+
+// Permits reports if certificate subject or any of its alternative names is allowed
+func (a *AllowList) Permits(cert *x509.Certificate) bool {
+
+	if _, ok := a.cn[cert.Subject.CommonName]; ok {
+		return true
+	}
+
+	for _, name := range SubjectAltNames(cert) {
+		if _, ok := a.san[name]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SubjectAltNames lists DNS names, emails, IP addresses and URIs of certificate
+func SubjectAltNames(cert *x509.Certificate) []string {
+
+	names := make([]string, 0, len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.IPAddresses)+len(cert.URIs))
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	return names
+}
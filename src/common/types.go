@@ -1,24 +1,85 @@
 package common
 
+import (
+	"context"
+	"time"
+)
+
 const (
 	IngestTLS       IngestType = "tls"
 	IngestRedis     IngestType = "redis"
 	IngestHTTPS     IngestType = "https"
 	IngestSimulated IngestType = "simulated"
+	IngestTCP       IngestType = "tcp"
+	IngestUDP       IngestType = "udp"
+	IngestSyslog    IngestType = "syslog"
 
 	DigestRedis     DigestType = "redis"
 	DigestWebSocket DigestType = "ws"
 	DigestFile      DigestType = "file"
 	DigestElastic   DigestType = "elastic"
+
+	OverflowBlock      OverflowPolicy = "block"
+	OverflowDropNewest OverflowPolicy = "drop-newest"
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	OverflowSpill      OverflowPolicy = "spill"
+
+	FramingDelimiter     Framing = "delimiter"
+	FramingLengthPrefix  Framing = "length-prefix"
+	FramingOctetCounting Framing = "octet-counting"
+	FramingMultiline     Framing = "multiline"
+
+	SlowClientDrop       SlowClientPolicy = "drop"
+	SlowClientDisconnect SlowClientPolicy = "disconnect"
+
+	SyslogUDP SyslogTransport = "udp"
+	SyslogTCP SyslogTransport = "tcp"
+	SyslogTLS SyslogTransport = "tls"
+
+	ClientAuthNone             ClientAuth = "none"
+	ClientAuthRequest          ClientAuth = "request"
+	ClientAuthRequireAndVerify ClientAuth = "require-and-verify"
+
+	RedisSubscribe RedisMode = "subscribe"
+	RedisStream    RedisMode = "stream"
+	RedisPublish   RedisMode = "publish"
+	RedisXAdd      RedisMode = "xadd"
+	RedisLPush     RedisMode = "lpush"
+	RedisRPush     RedisMode = "rpush"
 )
 
 type DigestType string
 type IngestType string
+type OverflowPolicy string
+type RedisMode string
+type ClientAuth string
+type SyslogTransport string
+type Framing string
+type SlowClientPolicy string
+
+// Duration wraps time.Duration to be decoded from strings like "10s" or "24h"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// WSToken is static bearer token of websocket client. messages sent to the client are limited to ones
+// having every Scope field equal to the given value
+type WSToken struct {
+	Token string            `toml:"Token"`
+	Scope map[string]string `toml:"Scope,omitempty"`
+}
 
 type AppConfig struct {
-	LogConfig    LogConfig              `toml:"Logger"`
-	IngestPoints map[string]PointConfig `toml:"IngestPoints"`
-	DigestPoints map[string]PointConfig `toml:"DigestPoints"`
+	ShutdownTimeout Duration               `toml:"ShutdownTimeout,omitempty"`
+	LogConfig       LogConfig              `toml:"Logger"`
+	Metrics         MetricsConfig          `toml:"Metrics"`
+	IngestPoints    map[string]PointConfig `toml:"IngestPoints"`
+	DigestPoints    map[string]PointConfig `toml:"DigestPoints"`
 }
 
 type LogConfig struct {
@@ -27,31 +88,82 @@ type LogConfig struct {
 	Fields []string `toml:"Fields,omitempty"`
 }
 
+type MetricsConfig struct {
+	Host     string `toml:"Host,omitempty"`
+	Port     int    `toml:"Port,omitempty"`
+	Endpoint string `toml:"Endpoint,omitempty"`
+}
+
 type PointConfig struct {
-	Name        string   `toml:"Name"`
-	Type        string   `toml:"Type,omitempty"`
-	Disabled    bool     `toml:"Disabled,omitempty"`
-	Host        string   `toml:"Host,omitempty"`
-	Port        int      `toml:"Port,omitempty"`
-	Endpoint    string   `toml:"Endpoint,omitempty"`
-	Pattern     string   `toml:"Pattern,omitempty"`
-	Certificate string   `toml:"Certificate,omitempty"`
-	Key         string   `toml:"Key,omitempty"`
-	CA          string   `toml:"CA,omitempty"`
-	Ingests     []string `toml:"Ingests,omitempty"`
-	Delimiter   byte     `toml:"Delimiter,omitempty"`
-	Buffer      int      `toml:"Buffer,omitempty"`
-	ESIndex     string   `toml:"ESIndex,omitempty"`
-	ESDocument  string   `toml:"ESDocument,omitempty"`
-	ESBatchSize int      `toml:"ESBatchSize,omitempty"`
-	MsgLength   int      `toml:"MsgLength,omitempty"`
-	MsgPerSec   int      `toml:"MsgPerSec,omitempty"`
+	Name               string      `toml:"Name"`
+	Type               string      `toml:"Type,omitempty"`
+	Disabled           bool        `toml:"Disabled,omitempty"`
+	Host               string      `toml:"Host,omitempty"`
+	Bind               string      `toml:"Bind,omitempty"`
+	Transport          string      `toml:"Transport,omitempty"`
+	Port               int         `toml:"Port,omitempty"`
+	Endpoint           string      `toml:"Endpoint,omitempty"`
+	Pattern            string      `toml:"Pattern,omitempty"`
+	FallbackChannel    string      `toml:"FallbackChannel,omitempty"`
+	Mode               string      `toml:"Mode,omitempty"`
+	Stream             string      `toml:"Stream,omitempty"`
+	Group              string      `toml:"Group,omitempty"`
+	Consumer           string      `toml:"Consumer,omitempty"`
+	ReclaimIdle        Duration    `toml:"ReclaimIdle,omitempty"`
+	Redis              RedisConfig `toml:"Redis,omitempty"`
+	MaxLen             int64       `toml:"MaxLen,omitempty"`
+	MaxRetries         int         `toml:"MaxRetries,omitempty"`
+	RetryBackoff       Duration    `toml:"RetryBackoff,omitempty"`
+	Certificate        string      `toml:"Certificate,omitempty"`
+	Key                string      `toml:"Key,omitempty"`
+	CA                 string      `toml:"CA,omitempty"`
+	ClientAuth         string      `toml:"ClientAuth,omitempty"`
+	AllowedCN          []string    `toml:"AllowedCN,omitempty"`
+	AllowedSAN         []string    `toml:"AllowedSAN,omitempty"`
+	Ingests            []string    `toml:"Ingests,omitempty"`
+	Delimiter          byte        `toml:"Delimiter,omitempty"`
+	Framing            string      `toml:"Framing,omitempty"`
+	MultilinePattern   string      `toml:"MultilinePattern,omitempty"`
+	Buffer             int         `toml:"Buffer,omitempty"`
+	MaxMessageSize     int         `toml:"MaxMessageSize,omitempty"`
+	Queue              int         `toml:"Queue,omitempty"`
+	Overflow           string      `toml:"OverflowPolicy,omitempty"`
+	SpillPath          string      `toml:"SpillPath,omitempty"`
+	SpillLimit         int64       `toml:"SpillLimit,omitempty"`
+	ESIndex            string      `toml:"ESIndex,omitempty"`
+	ESDocument         string      `toml:"ESDocument,omitempty"`
+	ESBatchSize        int         `toml:"ESBatchSize,omitempty"`
+	ESBatchBytes       int         `toml:"ESBatchBytes,omitempty"`
+	ESFlushInterval    Duration    `toml:"ESFlushInterval,omitempty"`
+	ESMaxRetries       int         `toml:"ESMaxRetries,omitempty"`
+	ESRetryBackoff     Duration    `toml:"ESRetryBackoff,omitempty"`
+	DeadLetter         string      `toml:"DeadLetter,omitempty"`
+	DeadLetterPath     string      `toml:"DeadLetterPath,omitempty"`
+	ESUsername         string      `toml:"ESUsername,omitempty"`
+	ESPassword         string      `toml:"ESPassword,omitempty"`
+	ESAPIKey           string      `toml:"ESAPIKey,omitempty"`
+	ESToken            string      `toml:"ESToken,omitempty"`
+	InsecureSkipVerify bool        `toml:"InsecureSkipVerify,omitempty"`
+	MsgLength          int         `toml:"MsgLength,omitempty"`
+	MsgPerSec          int         `toml:"MsgPerSec,omitempty"`
+	Path               string      `toml:"Path,omitempty"`
+	RotateSize         int64       `toml:"RotateSize,omitempty"`
+	RotateEvery        Duration    `toml:"RotateEvery,omitempty"`
+	Compress           bool        `toml:"Compress,omitempty"`
+	PingInterval       Duration    `toml:"PingInterval,omitempty"`
+	PongTimeout        Duration    `toml:"PongTimeout,omitempty"`
+	ClientQueue        int         `toml:"ClientQueue,omitempty"`
+	SlowClient         string      `toml:"SlowClient,omitempty"`
+	AllowedOrigins     []string    `toml:"AllowedOrigins,omitempty"`
+	Tokens             []WSToken   `toml:"Tokens,omitempty"`
+	JWTKey             string      `toml:"JWTKey,omitempty"`
+	ReplayBuffer       int         `toml:"ReplayBuffer,omitempty"`
 }
 
 type IngestPoint struct {
 	Type IngestType
 	Name string
-	Msg  chan string
+	Msg  chan *Message
 }
 
 type DigestPoint struct {
@@ -59,10 +171,25 @@ type DigestPoint struct {
 	Name string
 }
 
+// Lifecycle is implemented by ingest and digest points. Stop must release resources before ctx is done
+type Lifecycle interface {
+	Start() error
+	Stop(ctx context.Context) error
+}
+
 type Consumer interface {
-	Consume(msg string) error
+	Lifecycle
+	Consume(msg *Message) error
+}
+
+// Acknowledger is implemented by ingest points acknowledging settled messages to their source. Finish waits
+// for messages delivered before Stop to be settled, so it is called once digests are stopped and flushed
+type Acknowledger interface {
+	Finish(ctx context.Context) error
 }
 
+// Messenger closes Messages channel once stopped and all buffered messages are written
 type Messenger interface {
-	Messages() chan string
+	Lifecycle
+	Messages() chan *Message
 }
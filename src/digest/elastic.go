@@ -3,89 +3,532 @@ package digest
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"strings"
 	"time"
 
 	"logbay/common"
+	"logbay/metrics"
+	"logbay/template"
 )
 
+const (
+	maxRetryBackoff = time.Minute
+	maxReasonLength = 1024
+)
+
+// deadLetters keeps dead-letter digest point of every elastic digest to find loops
+var deadLetters = make(map[string]string)
+
 type ElasticDigestCfg struct {
-	Host      string
-	Index     string
-	Document  string
-	BatchSize int
+	Host           string
+	Index          string
+	Document       string
+	BatchSize      int
+	BatchBytes     int
+	FlushInterval  time.Duration
+	MaxRetries     int
+	RetryBackoff   time.Duration
+	DeadLetter     string
+	DeadLetterPath string
+	Username       string
+	Password       string
+	APIKey         string
+	Token          string
+	CA             string
+	Certificate    string
+	Key            string
+	Insecure       bool
 }
 
 type elasticDigest struct {
 	common.DigestPoint
-	endpoint  string
-	index     string
-	document  string
-	batchSize int
-	ch        chan string
+	endpoint      string
+	index         *template.Template
+	batchSize     int
+	batchBytes    int
+	flushInterval time.Duration
+	maxRetries    int
+	retryBackoff  time.Duration
+	deadLetter    string
+	deadFile      common.Consumer
+	client        *http.Client
+	authorization string
+	ch            chan *common.Message
+	dead          chan bulkFailure
+	stop          chan struct{}
+	done          chan struct{}
+	deadDone      chan struct{}
+}
+
+// bulkResponse is a part of _bulk API response needed to find out which items failed
+type bulkResponse struct {
+	Errors bool                      `json:"errors"`
+	Items  []map[string]bulkItemResp `json:"items"`
+}
+
+type bulkItemResp struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error,omitempty"`
+}
+
+type bulkError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// bulkItem is a document with its action line
+type bulkItem struct {
+	index  string
+	action string
+	doc    []byte
+	msg    *common.Message
+}
+
+type bulkFailure struct {
+	item      bulkItem
+	status    int
+	errorType string
+	reason    string
+}
+
+// deadLetterRecord is passed to dead-letter destination instead of bare payload, so it is known why
+// message wasn't indexed
+type deadLetterRecord struct {
+	Index      string    `json:"index"`
+	Status     int       `json:"status,omitempty"`
+	ErrorType  string    `json:"errorType,omitempty"`
+	Reason     string    `json:"reason"`
+	Ingest     string    `json:"ingest"`
+	ReceivedAt time.Time `json:"receivedAt"`
+	Payload    string    `json:"payload"`
+}
+
+// Consume queues message to be indexed. message is held until it is indexed or passed to dead-letter
+// destination, so ingest points acknowledging messages don't do it too early
+func (e *elasticDigest) Consume(msg *common.Message) error {
+
+	msg.Hold(1)
+
+	select {
+	case e.ch <- msg:
+		return nil
+	case <-e.stop:
+		msg.Release(false)
+		return errors.New(fmt.Sprintf("%s is stopped", e.Name))
+	}
+}
+
+func (e *elasticDigest) Start() error {
+
+	if e.deadFile != nil {
+		if err := e.deadFile.Start(); err != nil {
+			return err
+		}
+	}
+
+	go e.collect()
+	go e.bury()
+	return nil
 }
 
-func (e *elasticDigest) Consume(msg string) error {
-	e.ch <- msg
+// Stop flushes partially filled batch and waits for rejected items to reach dead-letter destination
+func (e *elasticDigest) Stop(ctx context.Context) error {
+
+	close(e.stop)
+
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	close(e.dead)
+
+	select {
+	case <-e.deadDone:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if e.deadFile != nil {
+		return e.deadFile.Stop(ctx)
+	}
+
 	return nil
 }
 
+// collect flushes batch when it has enough messages, grows too big or flush interval passes
 func (e *elasticDigest) collect() {
 
-	payload := make([]string, e.batchSize)
-	counter := 0
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]bulkItem, 0, e.batchSize)
+	size := 0
+
+	flush := func() {
+		if len(batch) > 0 {
+			e.send(batch)
+			batch = batch[:0]
+			size = 0
+		}
+	}
 
-loop:
 	for {
 		select {
-		case msg, ok := <-e.ch:
+		case <-e.stop:
+			// flush partially filled batch once digest is stopped
+			flush()
+			return
+		case msg := <-e.ch:
 
+			item, ok := e.item(msg)
+
+			// index like logbay--2019.07.01 is most likely not what is wanted
 			if !ok {
-				send(e.endpoint, payload[:counter])
-				break loop
+				e.reject(bulkFailure{item: item, reason: fmt.Sprintf("index %s can't be resolved", e.index)})
+				continue
 			}
 
-			if counter >= e.batchSize {
-				send(e.endpoint, payload)
-				counter = 0
+			if e.batchBytes > 0 && size+item.size() > e.batchBytes {
+				flush()
 			}
 
-			payload[counter] = msg
-			counter = counter + 1
-		default:
-			time.Sleep(100 * time.Millisecond)
+			batch = append(batch, item)
+			size += item.size()
+
+			if len(batch) >= e.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
 		}
 	}
+}
+
+// item builds bulk item for msg. false is returned if index template fields can't be resolved
+func (e *elasticDigest) item(msg *common.Message) (bulkItem, bool) {
+
+	index, ok := e.index.Execute(msg)
+	index = strings.ToLower(index)
+
+	action, _ := json.Marshal(map[string]interface{}{
+		"index": map[string]string{"_index": index},
+	})
 
-	close(e.ch)
+	return bulkItem{
+		index:  index,
+		action: string(action),
+		doc:    document(msg),
+		msg:    msg,
+	}, ok
 }
 
-func send(endpoint string, strings []string) {
+// document adds @timestamp of message receive time to JSON object payload unless it has one.
+// other payloads are wrapped into an object with message field
+func document(msg *common.Message) []byte {
+
+	ts, _ := json.Marshal(msg.ReceivedAt.Format(time.RFC3339Nano))
+	payload := bytes.TrimSpace(msg.Payload)
+
+	var fields map[string]json.RawMessage
+
+	if err := json.Unmarshal(payload, &fields); err != nil || fields == nil {
+		doc, _ := json.Marshal(map[string]string{
+			"@timestamp": msg.ReceivedAt.Format(time.RFC3339Nano),
+			"message":    string(msg.Payload),
+		})
+		return doc
+	}
+
+	if _, ok := fields["@timestamp"]; ok {
+		return payload
+	}
+
+	var doc bytes.Buffer
+
+	doc.WriteString(`{"@timestamp":`)
+	doc.Write(ts)
+
+	if len(fields) > 0 {
+		doc.WriteByte(',')
+	}
+
+	// keep original fields order by splicing timestamp after opening brace
+	doc.Write(bytes.TrimSpace(payload[1:]))
+
+	return doc.Bytes()
+}
+
+func (i bulkItem) size() int {
+	return len(i.action) + len(i.doc) + 2
+}
+
+// send indexes batch retrying rejected items with exponential backoff. items which can't be indexed
+// go to dead-letter destination
+func (e *elasticDigest) send(batch []bulkItem) {
 
 	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "elasticDigest"))
 
+	pending := batch
+	backoff := e.retryBackoff
+
+	for attempt := 0; ; attempt++ {
+		retry, failed := e.bulk(pending)
+
+		// accepted items are settled right away, rejected ones once they are retried or dead-lettered
+		rejected := make(map[*common.Message]bool, len(retry)+len(failed))
+
+		for _, list := range [][]bulkFailure{retry, failed} {
+			for _, f := range list {
+				rejected[f.item.msg] = true
+			}
+		}
+
+		for _, v := range pending {
+			if !rejected[v.msg] {
+				v.msg.Release(true)
+			}
+		}
+
+		for _, f := range failed {
+			e.reject(f)
+		}
+
+		if len(retry) == 0 {
+			return
+		}
+
+		if attempt >= e.maxRetries {
+			log.Errorf("%d items are not indexed after %d retries", len(retry), e.maxRetries)
+
+			for _, f := range retry {
+				e.reject(f)
+			}
+
+			return
+		}
+
+		log.Warnf("%d items are rejected. Retrying in %s", len(retry), backoff)
+
+		pending = make([]bulkItem, len(retry))
+
+		for i, f := range retry {
+			pending[i] = f.item
+		}
+
+		time.Sleep(backoff)
+
+		if backoff = backoff * 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// bulk executes _bulk request and returns items worth retrying and items failed permanently
+func (e *elasticDigest) bulk(items []bulkItem) (retry []bulkFailure, failed []bulkFailure) {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "elasticDigest"))
+
+	all := func(status int, reason string) []bulkFailure {
+		result := make([]bulkFailure, len(items))
+		for i, v := range items {
+			result[i] = bulkFailure{item: v, status: status, reason: reason}
+		}
+		return result
+	}
+
 	var buf bytes.Buffer
 
-	for _, v := range strings {
-		buf.WriteString(fmt.Sprintf("%s\n", `{ "index" : { } }`))
-		buf.WriteString(fmt.Sprintf("%s\n", v))
+	for _, v := range items {
+		buf.WriteString(fmt.Sprintf("%s\n", v.action))
+		buf.Write(v.doc)
+		buf.WriteByte('\n')
 	}
 
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, &buf)
+
+	if err != nil {
+		return nil, all(0, err.Error())
 	}
 
-	resp, err := client.Post(endpoint, "application/x-ndjson", &buf)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	if len(e.authorization) > 0 {
+		req.Header.Set("Authorization", e.authorization)
+	}
+
+	started := time.Now()
+	resp, err := e.client.Do(req)
+	metrics.ElasticBulkDuration.WithLabelValues(e.Name).Observe(time.Since(started).Seconds())
+
+	if err != nil {
+		metrics.ElasticBulkFailures.WithLabelValues(e.Name).Inc()
+		log.Errorf("request to %s failed. Err: %s", e.endpoint, err.Error())
+		return all(0, err.Error()), nil
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
 
 	if err != nil {
-		log.Errorf("request to %s failed", endpoint, err)
-		return
+		metrics.ElasticBulkFailures.WithLabelValues(e.Name).Inc()
+		log.Errorf("Can't read response from %s. Err: %s", e.endpoint, err.Error())
+		return all(0, err.Error()), nil
 	}
 
-	resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		metrics.ElasticBulkFailures.WithLabelValues(e.Name).Inc()
+		reason := truncate(string(body), maxReasonLength)
+		log.Errorf("request to %s failed with status %d", e.endpoint, resp.StatusCode)
+
+		if retryable(resp.StatusCode) {
+			return all(resp.StatusCode, reason), nil
+		}
+
+		return nil, all(resp.StatusCode, reason)
+	}
+
+	var result bulkResponse
+
+	if err := json.Unmarshal(body, &result); err != nil {
+		// request is accepted, so resending it may produce duplicates
+		log.Errorf("Can't parse _bulk response. Err: %s", err.Error())
+		return nil, nil
+	}
+
+	if !result.Errors {
+		return nil, nil
+	}
+
+	if len(result.Items) != len(items) {
+		log.Errorf("_bulk response has %d items, %d expected", len(result.Items), len(items))
+		return nil, nil
+	}
+
+	for i, item := range result.Items {
+		// every item has a single key named after action
+		for _, r := range item {
+			if r.Status < http.StatusMultipleChoices {
+				continue
+			}
+
+			f := bulkFailure{item: items[i], status: r.Status, reason: string(r.Error)}
+
+			var cause bulkError
+
+			if err := json.Unmarshal(r.Error, &cause); err == nil && len(cause.Reason) > 0 {
+				f.errorType = cause.Type
+				f.reason = cause.Reason
+			}
+
+			if retryable(r.Status) {
+				retry = append(retry, f)
+			} else {
+				failed = append(failed, f)
+			}
+		}
+	}
+
+	return retry, failed
+}
+
+// reject queues item to be passed to dead-letter destination. collect doesn't wait for destination
+// to accept it, since destination may be slow or consume from this digest in turn
+func (e *elasticDigest) reject(f bulkFailure) {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "elasticDigest"))
+
+	log.Warnf("Item is not indexed into %s. Status: %d. Type: %s. Reason: %s", f.item.index, f.status,
+		f.errorType, f.reason)
+
+	e.dead <- f
+}
+
+// bury passes rejected items to dead-letter destination until digest is stopped
+func (e *elasticDigest) bury() {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "elasticDigest"))
+
+	defer close(e.deadDone)
+
+	for f := range e.dead {
+		var target common.Consumer
+
+		if e.deadFile != nil {
+			target = e.deadFile
+		} else if len(e.deadLetter) > 0 {
+			if d, ok := GetDigestPoint(e.deadLetter); ok {
+				target = d
+			} else {
+				log.Warnf("Dead-letter digest point %s doesn't exist", e.deadLetter)
+			}
+		}
+
+		if target == nil {
+			f.item.msg.Release(false)
+			continue
+		}
+
+		// original message is settled once dead-letter destination is done with the record
+		record := deadLetter(f)
+		record.OnSettle(f.item.msg.Release)
+		record.Hold(1)
+
+		err := target.Consume(record)
+
+		if err != nil {
+			log.Errorf("Can't write item to dead-letter destination. Err: %s", err.Error())
+		}
+
+		record.Release(err == nil)
+	}
+}
+
+// deadLetter wraps failed message into a record with failure reason
+func deadLetter(f bulkFailure) *common.Message {
+
+	msg := f.item.msg
+
+	payload, _ := json.Marshal(deadLetterRecord{
+		Index:      f.item.index,
+		Status:     f.status,
+		ErrorType:  f.errorType,
+		Reason:     f.reason,
+		Ingest:     msg.Ingest,
+		ReceivedAt: msg.ReceivedAt,
+		Payload:    string(msg.Payload),
+	})
+
+	return &common.Message{
+		Payload:    payload,
+		Ingest:     msg.Ingest,
+		ReceivedAt: msg.ReceivedAt,
+		Remote:     msg.Remote,
+		Seq:        msg.Seq,
+		Meta:       msg.Meta,
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
 }
 
 func NewElasticDigest(name string, cfg *ElasticDigestCfg) (common.Consumer, error) {
@@ -96,8 +539,14 @@ func NewElasticDigest(name string, cfg *ElasticDigestCfg) (common.Consumer, erro
 		return nil, errors.New("index is required")
 	}
 
-	if len(cfg.Document) == 0 {
-		return nil, errors.New("document is required")
+	if len(cfg.Document) > 0 {
+		log.Warnf("Mapping types are removed from Elasticsearch. Document %s is ignored", cfg.Document)
+	}
+
+	index, err := template.Compile(cfg.Index)
+
+	if err != nil {
+		return nil, err
 	}
 
 	if len(cfg.Host) == 0 {
@@ -110,23 +559,142 @@ func NewElasticDigest(name string, cfg *ElasticDigestCfg) (common.Consumer, erro
 		cfg.BatchSize = 100
 	}
 
+	if cfg.FlushInterval == 0 {
+		log.Debugln("FlushInterval is not configured. Using 5s")
+		cfg.FlushInterval = 5 * time.Second
+	}
+
+	if cfg.MaxRetries == 0 {
+		log.Debugln("MaxRetries is not configured. Using 3")
+		cfg.MaxRetries = 3
+	}
+
+	if cfg.RetryBackoff == 0 {
+		log.Debugln("RetryBackoff is not configured. Using 1s")
+		cfg.RetryBackoff = time.Second
+	}
+
 	if len(name) == 0 {
 		name = fmt.Sprintf("elastic-digest#%d", rand.Int())
 	}
 
+	// file takes precedence over digest point
+	if len(cfg.DeadLetterPath) > 0 {
+		cfg.DeadLetter = ""
+	}
+
+	// dead letters passed back to the same digest would never leave it
+	for next := cfg.DeadLetter; len(next) > 0; next = deadLetters[next] {
+		if next == name {
+			return nil, errors.New(fmt.Sprintf("dead-letter digest point %s passes items back to %s",
+				cfg.DeadLetter, name))
+		}
+	}
+
+	authorization, err := elasticAuthorization(cfg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := common.ClientTLSConfig(cfg.CA, cfg.Certificate, cfg.Key, cfg.Insecure)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Insecure {
+		log.Warnf("TLS certificate verification is disabled for %s", cfg.Host)
+	}
+
 	d := &elasticDigest{
-		common.DigestPoint{
+		DigestPoint: common.DigestPoint{
 			Name: name,
 			Type: common.DigestElastic,
 		},
-		fmt.Sprintf("%s/%s/%s/_bulk", cfg.Host, cfg.Index, cfg.Document),
-		cfg.Index,
-		cfg.Document,
-		cfg.BatchSize,
-		make(chan string),
+		endpoint:      fmt.Sprintf("%s/_bulk", strings.TrimRight(cfg.Host, "/")),
+		index:         index,
+		batchSize:     cfg.BatchSize,
+		batchBytes:    cfg.BatchBytes,
+		flushInterval: cfg.FlushInterval,
+		maxRetries:    cfg.MaxRetries,
+		retryBackoff:  cfg.RetryBackoff,
+		deadLetter:    cfg.DeadLetter,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+		authorization: authorization,
+		ch:            make(chan *common.Message),
+		dead:          make(chan bulkFailure, cfg.BatchSize),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+		deadDone:      make(chan struct{}),
 	}
 
-	go d.collect()
+	if len(cfg.DeadLetterPath) > 0 {
+		deadFile, err := NewFileDigest(fmt.Sprintf("%s-dead-letter", name), &FileDigestCfg{
+			Path: cfg.DeadLetterPath,
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		d.deadFile = deadFile
+	}
+
+	deadLetters[name] = cfg.DeadLetter
 
 	return d, nil
 }
+
+// elasticAuthorization builds Authorization header value out of configured credentials.
+// credentials may be given as env:NAME or file:/path references
+func elasticAuthorization(cfg *ElasticDigestCfg) (string, error) {
+
+	configured := 0
+
+	for _, v := range []string{cfg.Username, cfg.APIKey, cfg.Token} {
+		if len(v) > 0 {
+			configured++
+		}
+	}
+
+	if configured > 1 {
+		return "", errors.New("only one of username, API key or token can be configured")
+	}
+
+	switch {
+	case len(cfg.Username) > 0:
+		password, err := common.ResolveSecret(cfg.Password)
+
+		if err != nil {
+			return "", err
+		}
+
+		credentials := base64.StdEncoding.EncodeToString([]byte(cfg.Username + ":" + password))
+		return "Basic " + credentials, nil
+	case len(cfg.APIKey) > 0:
+		key, err := common.ResolveSecret(cfg.APIKey)
+
+		if err != nil {
+			return "", err
+		}
+
+		return "ApiKey " + key, nil
+	case len(cfg.Token) > 0:
+		token, err := common.ResolveSecret(cfg.Token)
+
+		if err != nil {
+			return "", err
+		}
+
+		return "Bearer " + token, nil
+	}
+
+	return "", nil
+}
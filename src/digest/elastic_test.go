@@ -0,0 +1,463 @@
+package digest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"logbay/common"
+)
+
+// bulkStub replays prepared _bulk responses and records documents of every request
+type bulkStub struct {
+	mu        sync.Mutex
+	requests  [][]string
+	responses []func(docs []string) (int, string)
+}
+
+func (b *bulkStub) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+
+	body, _ := ioutil.ReadAll(r.Body)
+	lines := strings.Split(strings.TrimRight(string(body), "\n"), "\n")
+
+	// every document follows its action line
+	docs := make([]string, 0, len(lines)/2)
+
+	for i := 1; i < len(lines); i += 2 {
+		var doc struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal([]byte(lines[i]), &doc)
+		docs = append(docs, doc.Message)
+	}
+
+	b.mu.Lock()
+	n := len(b.requests)
+	b.requests = append(b.requests, docs)
+	b.mu.Unlock()
+
+	status, response := http.StatusOK, bulkAccepted(len(docs))
+
+	if n < len(b.responses) {
+		status, response = b.responses[n](docs)
+	}
+
+	rw.WriteHeader(status)
+	rw.Write([]byte(response))
+}
+
+func (b *bulkStub) sent() [][]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.requests
+}
+
+// bulkAccepted builds _bulk response with n created items
+func bulkAccepted(n int) string {
+
+	statuses := make([]int, n)
+
+	for i := range statuses {
+		statuses[i] = 201
+	}
+
+	return bulkItems(statuses...)
+}
+
+// bulkItems builds _bulk response with item statuses. failed items get error of matching type
+func bulkItems(statuses ...int) string {
+
+	items := make([]string, len(statuses))
+	errors := false
+
+	for i, status := range statuses {
+		switch status {
+		case 201:
+			items[i] = `{"index":{"status":201}}`
+		case 429:
+			errors = true
+			items[i] = `{"index":{"status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue is full"}}}`
+		default:
+			errors = true
+			items[i] = fmt.Sprintf(`{"index":{"status":%d,"error":{"type":"mapper_parsing_exception","reason":"failed to parse field [level]"}}}`, status)
+		}
+	}
+
+	return fmt.Sprintf(`{"took":1,"errors":%t,"items":[%s]}`, errors, strings.Join(items, ","))
+}
+
+func newTestElasticDigest(t *testing.T, url string, cfg ElasticDigestCfg) *elasticDigest {
+
+	cfg.Host = url
+	cfg.RetryBackoff = time.Millisecond
+
+	if len(cfg.Index) == 0 {
+		cfg.Index = "logbay"
+	}
+	if cfg.FlushInterval == 0 {
+		cfg.FlushInterval = time.Hour
+	}
+
+	d, err := NewElasticDigest(t.Name(), &cfg)
+
+	if err != nil {
+		t.Fatalf("Can't create digest. Err: %s", err.Error())
+	}
+
+	if err := d.Start(); err != nil {
+		t.Fatalf("Can't start digest. Err: %s", err.Error())
+	}
+
+	return d.(*elasticDigest)
+}
+
+func consume(t *testing.T, d common.Consumer, payloads ...string) {
+	for _, p := range payloads {
+		if err := d.Consume(common.NewMessage([]byte(p), "test")); err != nil {
+			t.Fatalf("Can't consume %s. Err: %s", p, err.Error())
+		}
+	}
+}
+
+func stop(t *testing.T, d common.Consumer) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := d.Stop(ctx); err != nil {
+		t.Fatalf("Can't stop digest. Err: %s", err.Error())
+	}
+}
+
+func readDeadLetters(t *testing.T, path string) []deadLetterRecord {
+
+	f, err := os.Open(path)
+
+	if err != nil {
+		t.Fatalf("Can't open dead-letter file. Err: %s", err.Error())
+	}
+
+	defer f.Close()
+
+	var records []deadLetterRecord
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		var r deadLetterRecord
+
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("Dead-letter record %s is not JSON. Err: %s", scanner.Text(), err.Error())
+		}
+
+		records = append(records, r)
+	}
+
+	return records
+}
+
+func TestElasticRetriesRejectedItem(t *testing.T) {
+
+	stub := &bulkStub{
+		responses: []func([]string) (int, string){
+			func([]string) (int, string) { return http.StatusOK, bulkItems(201, 429, 201) },
+		},
+	}
+
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "logbay")
+	defer os.RemoveAll(dir)
+
+	dead := filepath.Join(dir, "dead.log")
+	d := newTestElasticDigest(t, server.URL, ElasticDigestCfg{BatchSize: 3, DeadLetterPath: dead})
+
+	consume(t, d, "one", "two", "three")
+	stop(t, d)
+
+	sent := stub.sent()
+
+	if len(sent) != 2 {
+		t.Fatalf("Expected 2 requests, got %d: %v", len(sent), sent)
+	}
+
+	if len(sent[1]) != 1 || sent[1][0] != "two" {
+		t.Errorf("Expected only rejected item to be retried, got %v", sent[1])
+	}
+
+	if records := readDeadLetters(t, dead); len(records) != 0 {
+		t.Errorf("Expected no dead letters, got %v", records)
+	}
+}
+
+func TestElasticDeadLettersFailedItem(t *testing.T) {
+
+	stub := &bulkStub{
+		responses: []func([]string) (int, string){
+			func([]string) (int, string) { return http.StatusOK, bulkItems(201, 400) },
+		},
+	}
+
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "logbay")
+	defer os.RemoveAll(dir)
+
+	dead := filepath.Join(dir, "dead.log")
+	d := newTestElasticDigest(t, server.URL, ElasticDigestCfg{BatchSize: 2, DeadLetterPath: dead})
+
+	consume(t, d, "one", "plain text")
+	stop(t, d)
+
+	if sent := stub.sent(); len(sent) != 1 {
+		t.Fatalf("Expected permanently failed item not to be retried, got %d requests", len(sent))
+	}
+
+	records := readDeadLetters(t, dead)
+
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d", len(records))
+	}
+
+	r := records[0]
+
+	if r.Payload != "plain text" || r.Status != 400 || r.ErrorType != "mapper_parsing_exception" ||
+		r.Reason != "failed to parse field [level]" || r.Index != "logbay" || r.Ingest != "" {
+		t.Errorf("Unexpected dead letter %+v", r)
+	}
+}
+
+func TestElasticDeadLettersUnresolvedIndex(t *testing.T) {
+
+	stub := &bulkStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "logbay")
+	defer os.RemoveAll(dir)
+
+	dead := filepath.Join(dir, "dead.log")
+	d := newTestElasticDigest(t, server.URL, ElasticDigestCfg{
+		Index:          "logbay-{{service}}",
+		BatchSize:      2,
+		DeadLetterPath: dead,
+	})
+
+	consume(t, d, `{"service":"api"}`, "no service")
+	stop(t, d)
+
+	if sent := stub.sent(); len(sent) != 1 || len(sent[0]) != 1 {
+		t.Errorf("Expected only message with resolved index to be sent, got %v", sent)
+	}
+
+	if records := readDeadLetters(t, dead); len(records) != 1 || records[0].Payload != "no service" {
+		t.Errorf("Unexpected dead letters %v", records)
+	}
+}
+
+func TestElasticRequestFailure(t *testing.T) {
+
+	cases := []struct {
+		status   int
+		requests int
+		dead     int
+	}{
+		// whole batch is retried and accepted on the second attempt
+		{http.StatusServiceUnavailable, 2, 0},
+		// client errors are not retried
+		{http.StatusUnauthorized, 1, 2},
+	}
+
+	for _, c := range cases {
+		t.Run(http.StatusText(c.status), func(t *testing.T) {
+
+			stub := &bulkStub{
+				responses: []func([]string) (int, string){
+					func([]string) (int, string) { return c.status, `{"error":"nope"}` },
+				},
+			}
+
+			server := httptest.NewServer(stub)
+			defer server.Close()
+
+			dir, _ := ioutil.TempDir("", "logbay")
+			defer os.RemoveAll(dir)
+
+			dead := filepath.Join(dir, "dead.log")
+			d := newTestElasticDigest(t, server.URL, ElasticDigestCfg{BatchSize: 2, DeadLetterPath: dead})
+
+			consume(t, d, "one", "two")
+			stop(t, d)
+
+			if sent := stub.sent(); len(sent) != c.requests {
+				t.Errorf("Expected %d requests, got %d", c.requests, len(sent))
+			}
+
+			records := readDeadLetters(t, dead)
+
+			if len(records) != c.dead {
+				t.Fatalf("Expected %d dead letters, got %d", c.dead, len(records))
+			}
+
+			for _, r := range records {
+				if r.Status != c.status || r.Reason != `{"error":"nope"}` {
+					t.Errorf("Unexpected dead letter %+v", r)
+				}
+			}
+		})
+	}
+}
+
+func TestElasticSplitsBatches(t *testing.T) {
+
+	t.Run("BatchSize", func(t *testing.T) {
+
+		stub := &bulkStub{}
+		server := httptest.NewServer(stub)
+		defer server.Close()
+
+		d := newTestElasticDigest(t, server.URL, ElasticDigestCfg{BatchSize: 2})
+
+		consume(t, d, "1", "2", "3", "4", "5")
+		stop(t, d)
+
+		// the last one is flushed on stop
+		if sent := fmt.Sprint(stub.sent()); sent != "[[1 2] [3 4] [5]]" {
+			t.Errorf("Unexpected batches %s", sent)
+		}
+	})
+
+	t.Run("BatchBytes", func(t *testing.T) {
+
+		stub := &bulkStub{}
+		server := httptest.NewServer(stub)
+		defer server.Close()
+
+		d := newTestElasticDigest(t, server.URL, ElasticDigestCfg{BatchSize: 100})
+
+		// payloads with @timestamp are indexed as is, so every item has the same size
+		doc := `{"@timestamp":"2019-07-01T00:00:00Z","message":"%s"}`
+
+		item, _ := d.item(common.NewMessage([]byte(fmt.Sprintf(doc, "xxxxxxxxxx")), "test"))
+		d.batchBytes = 2*item.size() + 1
+
+		consume(t, d, fmt.Sprintf(doc, "aaaaaaaaaa"), fmt.Sprintf(doc, "bbbbbbbbbb"), fmt.Sprintf(doc, "cccccccccc"))
+		stop(t, d)
+
+		if sent := stub.sent(); len(sent) != 2 || len(sent[0]) != 2 || len(sent[1]) != 1 {
+			t.Errorf("Unexpected batches %v", sent)
+		}
+	})
+}
+
+func TestElasticSettlesAfterBulkResponse(t *testing.T) {
+
+	cases := []struct {
+		name       string
+		deadLetter bool
+		expected   string
+	}{
+		{"DeadLetter", true, "one:true two:true"},
+		{"NoDeadLetter", false, "one:true two:false"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+
+			respond := make(chan struct{})
+
+			stub := &bulkStub{
+				responses: []func([]string) (int, string){
+					func([]string) (int, string) {
+						<-respond
+						return http.StatusOK, bulkItems(201, 400)
+					},
+				},
+			}
+
+			server := httptest.NewServer(stub)
+			defer server.Close()
+
+			dir, _ := ioutil.TempDir("", "logbay")
+			defer os.RemoveAll(dir)
+
+			cfg := ElasticDigestCfg{BatchSize: 2}
+
+			if c.deadLetter {
+				cfg.DeadLetterPath = filepath.Join(dir, "dead.log")
+			}
+
+			d := newTestElasticDigest(t, server.URL, cfg)
+
+			settled := make(chan string, 2)
+
+			for _, p := range []string{"one", "two"} {
+				msg := common.NewMessage([]byte(p), "test")
+				msg.OnSettle(func(ok bool) { settled <- fmt.Sprintf("%s:%t", msg.Payload, ok) })
+
+				// the way router does it
+				msg.Hold(1)
+				err := d.Consume(msg)
+				msg.Release(err == nil)
+			}
+
+			select {
+			case s := <-settled:
+				t.Fatalf("Message %s is settled before bulk response", s)
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			close(respond)
+
+			results := []string{<-settled, <-settled}
+			sort.Strings(results)
+
+			if strings.Join(results, " ") != c.expected {
+				t.Errorf("Expected %s, got %v", c.expected, results)
+			}
+
+			stop(t, d)
+		})
+	}
+}
+
+func TestElasticConsumeAfterStop(t *testing.T) {
+
+	server := httptest.NewServer(&bulkStub{})
+	defer server.Close()
+
+	d := newTestElasticDigest(t, server.URL, ElasticDigestCfg{})
+	stop(t, d)
+
+	if err := d.Consume(common.NewMessage([]byte("late"), "test")); err == nil {
+		t.Error("Expected stopped digest to refuse message")
+	}
+}
+
+func TestElasticRejectsDeadLetterLoop(t *testing.T) {
+
+	if _, err := NewElasticDigest("self", &ElasticDigestCfg{Index: "logbay", DeadLetter: "self"}); err == nil {
+		t.Error("Expected digest passing dead letters to itself to be rejected")
+	}
+
+	if _, err := NewElasticDigest("ping", &ElasticDigestCfg{Index: "logbay", DeadLetter: "pong"}); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if _, err := NewElasticDigest("pong", &ElasticDigestCfg{Index: "logbay", DeadLetter: "ping"}); err == nil {
+		t.Error("Expected digests passing dead letters to each other to be rejected")
+	}
+}
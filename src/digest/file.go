@@ -0,0 +1,262 @@
+package digest
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"logbay/common"
+)
+
+type FileDigestCfg struct {
+	Path        string
+	RotateSize  int64
+	RotateEvery time.Duration
+	Compress    bool
+}
+
+type fileDigest struct {
+	common.DigestPoint
+	path       string
+	rotateSize int64
+	compress   bool
+	mu         sync.Mutex
+	file       *os.File
+	size       int64
+	every      time.Duration
+	stop       chan struct{}
+	compressed sync.WaitGroup
+}
+
+func NewFileDigest(name string, cfg *FileDigestCfg) (common.Consumer, error) {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "fileDigest"))
+
+	if len(cfg.Path) == 0 {
+		return nil, errors.New("path is required")
+	}
+
+	if len(name) == 0 {
+		name = fmt.Sprintf("file-digest#%d", rand.Int())
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	d := &fileDigest{
+		DigestPoint: common.DigestPoint{
+			Name: name,
+			Type: common.DigestFile,
+		},
+		path:       cfg.Path,
+		rotateSize: cfg.RotateSize,
+		compress:   cfg.Compress,
+		every:      cfg.RotateEvery,
+		stop:       make(chan struct{}),
+	}
+
+	if err := d.open(); err != nil {
+		return nil, err
+	}
+
+	log.Infof("Created new file digest point. Path: %s", cfg.Path)
+
+	return d, nil
+}
+
+func (f *fileDigest) Start() error {
+
+	go f.reopenOnHangup()
+
+	if f.every > 0 {
+		go f.rotateEvery(f.every)
+	}
+
+	return nil
+}
+
+// Stop closes the file and waits for rotated files to be compressed
+func (f *fileDigest) Stop(ctx context.Context) error {
+
+	close(f.stop)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.file.Close()
+
+	// compression doesn't take the lock. holding it keeps rotation from starting a new one meanwhile
+	if err := common.WaitContext(ctx, &f.compressed); err != nil {
+		return err
+	}
+
+	return err
+}
+
+func (f *fileDigest) Consume(msg *common.Message) error {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.rotateSize > 0 && f.size > 0 && f.size+int64(len(msg.Payload))+1 > f.rotateSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+
+	// payload is shared with other digests, so it must not be appended to in place
+	line := make([]byte, len(msg.Payload)+1)
+	copy(line, msg.Payload)
+	line[len(line)-1] = '\n'
+
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+
+	return err
+}
+
+// open opens file for appending. must be called with lock held
+func (f *fileDigest) open() error {
+
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+
+	return nil
+}
+
+// rotate moves current file aside and opens a new one. must be called with lock held
+func (f *fileDigest) rotate() error {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "fileDigest"))
+
+	f.file.Close()
+
+	rotated, err := common.RotateFile(f.path)
+
+	if err != nil {
+		log.Errorf("Can't rotate %s. Err: %s", f.path, err.Error())
+	}
+
+	if err := f.open(); err != nil {
+		log.Errorf("Can't open %s. Err: %s", f.path, err.Error())
+		return err
+	}
+
+	if f.compress && len(rotated) > 0 {
+		f.compressed.Add(1)
+		go func() {
+			defer f.compressed.Done()
+			compress(rotated)
+		}()
+	}
+
+	return nil
+}
+
+func (f *fileDigest) rotateEvery(interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			f.mu.Lock()
+			if f.size > 0 {
+				f.rotate()
+			}
+			f.mu.Unlock()
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// reopenOnHangup reopens the file on SIGHUP so external tools like logrotate can move it away
+func (f *fileDigest) reopenOnHangup() {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "fileDigest"))
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-signals:
+			log.Infof("SIGHUP received. Reopening %s", f.path)
+
+			f.mu.Lock()
+			f.file.Close()
+			if err := f.open(); err != nil {
+				log.Errorf("Can't reopen %s. Err: %s", f.path, err.Error())
+			}
+			f.mu.Unlock()
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// compress gzips rotated segment and removes the original
+func compress(name string) {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "fileDigest"))
+
+	err := func() error {
+		src, err := os.Open(name)
+
+		if err != nil {
+			return err
+		}
+
+		defer src.Close()
+
+		dst, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+
+		if err != nil {
+			return err
+		}
+
+		defer dst.Close()
+
+		gz := gzip.NewWriter(dst)
+
+		if _, err := io.Copy(gz, src); err != nil {
+			return err
+		}
+
+		return gz.Close()
+	}()
+
+	if err != nil {
+		log.Errorf("Can't compress %s. Err: %s", name, err.Error())
+		os.Remove(name + ".gz")
+		return
+	}
+
+	os.Remove(name)
+}
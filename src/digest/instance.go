@@ -6,32 +6,115 @@ import (
 	"fmt"
 
 	"logbay/common"
+	"logbay/metrics"
 )
 
+var storage = make(map[string]common.Consumer)
+
+// instrumented counts messages passed to digest point
+type instrumented struct {
+	common.Consumer
+	name string
+}
+
+func (i *instrumented) Consume(msg *common.Message) error {
+
+	metrics.DigestReceived.WithLabelValues(i.name).Inc()
+
+	err := i.Consumer.Consume(msg)
+
+	if err != nil {
+		metrics.DigestDropped.WithLabelValues(i.name).Inc()
+	}
+
+	return err
+}
+
 func New(config common.PointConfig) (common.Consumer, error) {
 
 	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "digest"))
 
 	log.Infof("Starting %s digest point. Type: %s", config.Name, config.Type)
 
+	consumer, err := create(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	d := &instrumented{consumer, config.Name}
+	storage[config.Name] = d
+
+	return d, nil
+}
+
+func GetDigestPoint(name string) (common.Consumer, bool) {
+	value, ok := storage[name]
+	return value, ok
+}
+
+func create(config common.PointConfig) (common.Consumer, error) {
+
 	switch common.DigestType(config.Type) {
 	case common.DigestElastic:
 		return NewElasticDigest(config.Name, &ElasticDigestCfg{
-			Host:      config.Host,
-			Index:     config.ESIndex,
-			Document:  config.ESDocument,
-			BatchSize: config.ESBatchSize,
+			Host:           config.Host,
+			Index:          config.ESIndex,
+			Document:       config.ESDocument,
+			BatchSize:      config.ESBatchSize,
+			BatchBytes:     config.ESBatchBytes,
+			FlushInterval:  config.ESFlushInterval.Duration,
+			MaxRetries:     config.ESMaxRetries,
+			RetryBackoff:   config.ESRetryBackoff.Duration,
+			DeadLetter:     config.DeadLetter,
+			DeadLetterPath: config.DeadLetterPath,
+			Username:       config.ESUsername,
+			Password:       config.ESPassword,
+			APIKey:         config.ESAPIKey,
+			Token:          config.ESToken,
+			CA:             config.CA,
+			Certificate:    config.Certificate,
+			Key:            config.Key,
+			Insecure:       config.InsecureSkipVerify,
 		})
 	case common.DigestRedis:
 		return NewRedisDigest(config.Name, &RedisDigestCfg{
-			Host:    config.Host,
-			Port:    config.Port,
-			Channel: config.Pattern,
+			Host:         config.Host,
+			Port:         config.Port,
+			Channel:      config.Pattern,
+			Fallback:     config.FallbackChannel,
+			Mode:         common.RedisMode(config.Mode),
+			MaxLen:       config.MaxLen,
+			MaxRetries:   config.MaxRetries,
+			RetryBackoff: config.RetryBackoff.Duration,
+			Redis:        config.Redis,
+		})
+	case common.DigestFile:
+		return NewFileDigest(config.Name, &FileDigestCfg{
+			Path:        config.Path,
+			RotateSize:  config.RotateSize,
+			RotateEvery: config.RotateEvery.Duration,
+			Compress:    config.Compress,
 		})
 	case common.DigestWebSocket:
 		return NewWSDigest(config.Name, &WSDigestCfg{
-			URL:  config.Endpoint,
-			Port: config.Port,
+			Bind:           config.Bind,
+			URL:            config.Endpoint,
+			Port:           config.Port,
+			Cert:           config.Certificate,
+			Key:            config.Key,
+			CA:             config.CA,
+			ClientAuth:     common.ClientAuth(config.ClientAuth),
+			AllowedCN:      config.AllowedCN,
+			AllowedSAN:     config.AllowedSAN,
+			PingInterval:   config.PingInterval.Duration,
+			PongTimeout:    config.PongTimeout.Duration,
+			ClientQueue:    config.ClientQueue,
+			SlowClient:     common.SlowClientPolicy(config.SlowClient),
+			AllowedOrigins: config.AllowedOrigins,
+			Tokens:         config.Tokens,
+			JWTKey:         config.JWTKey,
+			ReplayBuffer:   config.ReplayBuffer,
 		})
 	}
 
@@ -2,57 +2,153 @@ package digest
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
-	"regexp"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/go-redis/redis"
 
 	"logbay/common"
+	"logbay/metrics"
+	"logbay/template"
 )
 
 type RedisDigestCfg struct {
-	Host    string
-	Port    int
-	Channel string
+	Host         string
+	Port         int
+	Channel      string
+	Fallback     string
+	Mode         common.RedisMode
+	MaxLen       int64
+	MaxRetries   int
+	RetryBackoff time.Duration
+	Redis        common.RedisConfig
 }
 
 type redisDigest struct {
 	common.DigestPoint
-	redis   *redis.Client
-	signals map[string]chan int
-	channel string
+	redis        redis.UniversalClient
+	signals      map[string]chan int
+	channel      *template.Template
+	fallback     string
+	mode         common.RedisMode
+	maxLen       int64
+	maxRetries   int
+	retryBackoff time.Duration
 }
 
-func (r *redisDigest) Consume(msg string) error {
+func (r *redisDigest) Consume(msg *common.Message) error {
 
-	pattern := regexp.MustCompile("{{(.*?)}}")
-	hasTemplates := pattern.MatchString(r.channel)
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "redisDigest"))
+
+	key, ok := r.channel.Execute(msg)
 
-	channel := r.channel
+	if !ok {
+		if len(r.fallback) == 0 {
+			return errors.New(fmt.Sprintf("can't resolve channel %s", r.channel))
+		}
 
-	if hasTemplates {
-		channel = r.replaceTemplates(pattern, r.channel, msg)
+		key = r.fallback
 	}
 
-	if len(channel) > 0 {
-		r.redis.Publish(channel, msg)
+	backoff := r.retryBackoff
+
+	for attempt := 0; ; attempt++ {
+		err := r.write(key, msg)
+
+		if err == nil {
+			return nil
+		}
+
+		metrics.RedisPublishErrors.WithLabelValues(r.Name).Inc()
+
+		if attempt >= r.maxRetries || !redisRetryable(err) {
+			log.Errorf("Can't %s message to %s. Err: %s", r.mode, key, err.Error())
+			return err
+		}
+
+		log.Warnf("Can't %s message to %s. Retrying in %s. Err: %s", r.mode, key, backoff, err.Error())
+
+		time.Sleep(backoff)
+
+		if backoff = backoff * 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
 	}
+}
 
-	return nil
+// write sends message to key using configured mode. lists are capped to maxLen with LTRIM
+func (r *redisDigest) write(key string, msg *common.Message) error {
+
+	switch r.mode {
+	case common.RedisXAdd:
+		return r.redis.XAdd(&redis.XAddArgs{
+			Stream:       key,
+			MaxLenApprox: r.maxLen,
+			Values:       map[string]interface{}{"message": msg.Payload},
+		}).Err()
+	case common.RedisLPush, common.RedisRPush:
+		_, err := r.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+			if r.mode == common.RedisLPush {
+				pipe.LPush(key, msg.Payload)
+			} else {
+				pipe.RPush(key, msg.Payload)
+			}
+
+			if r.maxLen > 0 && r.mode == common.RedisLPush {
+				pipe.LTrim(key, 0, r.maxLen-1)
+			} else if r.maxLen > 0 {
+				pipe.LTrim(key, -r.maxLen, -1)
+			}
+
+			return nil
+		})
+		return err
+	}
+
+	return r.redis.Publish(key, msg.Payload).Err()
 }
 
-func (r *redisDigest) replaceTemplates(regex *regexp.Regexp, channel string, msg string) string {
-	return regex.ReplaceAllStringFunc(r.channel, func(match string) string {
-		key := regex.FindStringSubmatch(match)[1]
-		pattern := regexp.MustCompile(fmt.Sprintf(`\\?"%s\\?":\\?"(.*?)\\?"`, key))
+// redisFailoverErrors are prefixes of errors redis replies with while sentinel or cluster failover is in progress
+var redisFailoverErrors = []string{"READONLY", "LOADING", "CLUSTERDOWN", "TRYAGAIN"}
+
+// redisPoolTimeout is returned by go-redis when no connection is available in time
+const redisPoolTimeout = "redis: connection pool timeout"
+
+// redisRetryable reports if err is caused by connection or failover rather than rejected by redis server
+func redisRetryable(err error) bool {
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+
+	if err.Error() == redisPoolTimeout {
+		return true
+	}
 
-		if v := pattern.FindStringSubmatch(msg); len(v) > 0 {
-			return v[1]
+	for _, prefix := range redisFailoverErrors {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return true
 		}
+	}
 
-		return match
-	})
+	return false
+}
+
+func (r *redisDigest) Start() error {
+	return nil
+}
+
+func (r *redisDigest) Stop(ctx context.Context) error {
+	return r.redis.Close()
 }
 
 func NewRedisDigest(name string, cfg *RedisDigestCfg) (common.Consumer, error) {
@@ -74,24 +170,56 @@ func NewRedisDigest(name string, cfg *RedisDigestCfg) (common.Consumer, error) {
 		cfg.Channel = "logbay:entry"
 	}
 
+	switch cfg.Mode {
+	case "":
+		log.Debugf("Mode is not configured. Using %s", common.RedisPublish)
+		cfg.Mode = common.RedisPublish
+	case common.RedisPublish, common.RedisXAdd, common.RedisLPush, common.RedisRPush:
+	default:
+		return nil, errors.New(fmt.Sprintf("invalid redis digest mode %s", cfg.Mode))
+	}
+
+	if cfg.MaxRetries == 0 {
+		log.Debugln("MaxRetries is not configured. Using 3")
+		cfg.MaxRetries = 3
+	}
+
+	if cfg.RetryBackoff == 0 {
+		log.Debugln("RetryBackoff is not configured. Using 500ms")
+		cfg.RetryBackoff = 500 * time.Millisecond
+	}
+
 	if len(name) == 0 {
 		name = fmt.Sprintf("redis-digest#%d", rand.Int())
 	}
 
-	r := redis.NewClient(&redis.Options{
-		Addr: fmt.Sprintf("%s:%d", cfg.Host, cfg.Port),
-	})
+	channel, err := template.CompileFields(cfg.Channel)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := common.NewRedisClient(cfg.Host, cfg.Port, cfg.Redis)
+
+	if err != nil {
+		return nil, err
+	}
 
-	log.Infof("Created new redis digest point. Host: %s, Port: %d, Channel: %s", cfg.Host, cfg.Port, cfg.Channel)
+	log.Infof("Created new redis digest point. Host: %s, Port: %d, Channel: %s, Mode: %s", cfg.Host, cfg.Port, cfg.Channel, cfg.Mode)
 
 	d := &redisDigest{
-		common.DigestPoint{
+		DigestPoint: common.DigestPoint{
 			Name: name,
 			Type: common.DigestRedis,
 		},
-		r,
-		make(map[string]chan int, 0),
-		cfg.Channel,
+		redis:        r,
+		signals:      make(map[string]chan int, 0),
+		channel:      channel,
+		fallback:     cfg.Fallback,
+		mode:         cfg.Mode,
+		maxLen:       cfg.MaxLen,
+		maxRetries:   cfg.MaxRetries,
+		retryBackoff: cfg.RetryBackoff,
 	}
 
 	return d, nil
@@ -0,0 +1,32 @@
+package digest
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestRedisRetryable(t *testing.T) {
+
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{io.EOF, true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{errors.New("redis: connection pool timeout"), true},
+		{errors.New("READONLY You can't write against a read only replica."), true},
+		{errors.New("LOADING Redis is loading the dataset in memory"), true},
+		{errors.New("CLUSTERDOWN The cluster is down"), true},
+		{errors.New("TRYAGAIN Multiple keys request during rehashing of slot"), true},
+		{errors.New("WRONGTYPE Operation against a key holding the wrong kind of value"), false},
+		{errors.New("redis: client is closed"), false},
+	}
+
+	for _, c := range cases {
+		if redisRetryable(c.err) != c.retryable {
+			t.Errorf("Expected %q to be retryable: %t", c.err, c.retryable)
+		}
+	}
+}
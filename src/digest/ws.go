@@ -2,49 +2,95 @@ package digest
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 
 	"logbay/common"
+	"logbay/metrics"
 )
 
 const (
 	WriteTimeout     = 10 * time.Second
 	MaxWriteAttempts = 10 * time.Second
+	// maxClientMessage limits messages read from clients. clients send nothing but subscribe frames
+	maxClientMessage = 4096
 )
 
 type WSDigestCfg struct {
-	Port    int
-	URL     string
-	Ingests []common.IngestPoint
+	Bind           string
+	Port           int
+	URL            string
+	Cert           string
+	Key            string
+	CA             string
+	ClientAuth     common.ClientAuth
+	AllowedCN      []string
+	AllowedSAN     []string
+	PingInterval   time.Duration
+	PongTimeout    time.Duration
+	ClientQueue    int
+	SlowClient     common.SlowClientPolicy
+	AllowedOrigins []string
+	Tokens         []common.WSToken
+	JWTKey         string
+	ReplayBuffer   int
+	Ingests        []common.IngestPoint
 }
 
 type wsDigest struct {
 	common.DigestPoint
-	signals  map[string]chan int
-	messages chan *websocket.PreparedMessage
-	clients  *sync.Map
+	signals      map[string]chan int
+	clients      *sync.Map
+	url          string
+	server       *http.Server
+	listener     net.Listener
+	certs        *common.CertReloader
+	allowed      *common.AllowList
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	queueSize    int
+	slowClient   common.SlowClientPolicy
+	upgrader     websocket.Upgrader
+	auth         *wsAuth
+	// mu orders numbering of messages with registration of clients, so replay and live messages
+	// neither overlap nor leave a gap. it also keeps client goroutines from being added to wg once
+	// Stop is waiting for it
+	mu   sync.Mutex
+	ring *wsRing
+	stop chan struct{}
+	wg   sync.WaitGroup
 }
 
 type wsConn struct {
+	// pongReceivedAt is unix time in nanoseconds. kept first to be aligned for atomic access
+	pongReceivedAt int64
 	conn           *websocket.Conn
-	pongReceivedAt time.Time
-}
-
-var upgrader = websocket.Upgrader{
-	// default options
-	CheckOrigin: func(r *http.Request) bool { return true },
+	key            string
+	identity       *wsIdentity
+	envelope       bool
+	replay         []*websocket.PreparedMessage
+	queue          chan *websocket.PreparedMessage
+	filter         atomic.Value
+	closed         int32
+	done           chan struct{}
 }
 
 func NewWSDigest(name string, conf *WSDigestCfg) (common.Consumer, error) {
 
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "wsDigest"))
+
 	if conf.Port == 0 {
 		return nil, errors.New("port is not defined")
 	}
@@ -61,117 +107,528 @@ func NewWSDigest(name string, conf *WSDigestCfg) (common.Consumer, error) {
 		name = fmt.Sprintf("ws-digest#%d", rand.Int())
 	}
 
+	if conf.PingInterval == 0 {
+		conf.PingInterval = 30 * time.Second
+	}
+
+	if conf.PongTimeout == 0 {
+		conf.PongTimeout = 2 * conf.PingInterval
+	}
+
+	if conf.PongTimeout < conf.PingInterval {
+		return nil, errors.New("pong timeout should be longer than ping interval")
+	}
+
+	if conf.ClientQueue == 0 {
+		conf.ClientQueue = 256
+	}
+
+	switch conf.SlowClient {
+	case "":
+		conf.SlowClient = common.SlowClientDrop
+	case common.SlowClientDrop, common.SlowClientDisconnect:
+	default:
+		return nil, errors.New(fmt.Sprintf("invalid slow client policy %s", conf.SlowClient))
+	}
+
+	auth, err := newWSAuth(conf.Tokens, conf.JWTKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if auth == nil {
+		log.Warnf("Neither Tokens nor JWTKey is configured. Anyone reaching %s can read messages", conf.URL)
+	}
+
+	if len(conf.Bind) == 0 {
+		conf.Bind = "0.0.0.0"
+	}
+
+	if conf.ReplayBuffer == 0 {
+		conf.ReplayBuffer = 1000
+	}
+
+	if conf.ReplayBuffer < 0 {
+		conf.ReplayBuffer = 0
+	}
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	if len(conf.AllowedOrigins) > 0 {
+		upgrader.CheckOrigin = checkOrigin(conf.AllowedOrigins)
+	} else {
+		log.Warnf("AllowedOrigins is not configured. Browser clients from any origin can connect to %s", conf.URL)
+	}
+
 	d := &wsDigest{
-		common.DigestPoint{
+		DigestPoint: common.DigestPoint{
 			Name: name,
 			Type: common.DigestWebSocket,
 		},
-		make(map[string]chan int),
-		make(chan *websocket.PreparedMessage),
-		&sync.Map{},
+		signals:      make(map[string]chan int),
+		clients:      &sync.Map{},
+		url:          conf.URL,
+		pingInterval: conf.PingInterval,
+		pongTimeout:  conf.PongTimeout,
+		queueSize:    conf.ClientQueue,
+		slowClient:   conf.SlowClient,
+		upgrader:     upgrader,
+		auth:         auth,
+		ring:         newWSRing(conf.ReplayBuffer),
+		stop:         make(chan struct{}),
 	}
 
-	d.listen(conf.URL, conf.Port)
+	mux := http.NewServeMux()
+	mux.HandleFunc(conf.URL, d.handle)
+
+	d.server = &http.Server{
+		Addr:    net.JoinHostPort(conf.Bind, strconv.Itoa(conf.Port)),
+		Handler: mux,
+	}
 
-	go d.broadcast()
+	// wss is served if certificate is configured
+	if len(conf.Cert) > 0 || len(conf.Key) > 0 {
+		config, certs, err := common.ServerTLS(&common.ServerTLSConfig{
+			Cert:       conf.Cert,
+			Key:        conf.Key,
+			CA:         conf.CA,
+			ClientAuth: conf.ClientAuth,
+			AllowedCN:  conf.AllowedCN,
+			AllowedSAN: conf.AllowedSAN,
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		d.server.TLSConfig = config
+		d.certs = certs
+		d.allowed = common.NewAllowList(conf.AllowedCN, conf.AllowedSAN)
+	} else if len(conf.ClientAuth) > 0 || len(conf.AllowedCN) > 0 || len(conf.AllowedSAN) > 0 {
+		return nil, errors.New("ClientAuth, AllowedCN and AllowedSAN require Certificate and Key")
+	}
 
 	return d, nil
 }
 
-func (w *wsDigest) listen(url string, port int) {
+// Start fails if server can't listen on configured address
+func (w *wsDigest) Start() error {
 
 	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "wsDigest"))
 
-	h := func(rw http.ResponseWriter, r *http.Request) {
+	listener, err := net.Listen("tcp", w.server.Addr)
 
-		c, err := upgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		log.Errorf("Failed to start server. Err: %s", err.Error())
+		return err
+	}
 
-		if err != nil {
-			log.Errorln("switching protocols:", err)
-			return
+	scheme := "ws"
+
+	if w.server.TLSConfig != nil {
+		listener = tls.NewListener(listener, w.server.TLSConfig)
+		scheme = "wss"
+
+		go w.certs.Watch()
+	}
+
+	w.listener = listener
+
+	log.Infof("Serving %s://%s%s", scheme, w.server.Addr, w.url)
+
+	go func() {
+		if err := w.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Websocket server stopped. Err: %s", err.Error())
 		}
+	}()
+
+	w.wg.Add(1)
+	go w.ping()
 
-		clientKey := c.RemoteAddr().String()
-		c.SetCloseHandler(func(code int, text string) error {
-			w.clients.Delete(clientKey)
-			return nil
+	return nil
+}
+
+// Stop delivers messages queued for clients and closes every client with a close frame. clients
+// which can't be flushed before ctx is done are disconnected right away
+func (w *wsDigest) Stop(ctx context.Context) error {
+
+	w.mu.Lock()
+	close(w.stop)
+	w.mu.Unlock()
+
+	err := common.WaitContext(ctx, &w.wg)
+
+	if err != nil {
+		w.clients.Range(func(key, value interface{}) bool {
+			w.evict(value.(*wsConn), "shutdown timeout")
+			return true
 		})
+	}
 
-		c.SetPongHandler(func(appData string) error {
-			value, ok := w.clients.Load(clientKey)
+	if shutdownErr := w.server.Shutdown(ctx); err == nil {
+		err = shutdownErr
+	}
 
-			if !ok {
-				return nil
-			}
+	if w.listener != nil && w.certs != nil {
+		w.certs.Close()
+	}
+
+	return err
+}
 
-			wsConn, ok := value.(*wsConn)
+// handle authenticates client and upgrades connection to websocket
+func (w *wsDigest) handle(rw http.ResponseWriter, r *http.Request) {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "wsDigest"))
+
+	if w.allowed != nil {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || !w.allowed.Permits(r.TLS.VerifiedChains[0][0]) {
+			log.Warnf("Rejected client %s. Err: client certificate is not allowed", r.RemoteAddr)
+			http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+
+	identity := &wsIdentity{}
+
+	if w.auth != nil {
+		var err error
+
+		if identity, err = w.auth.authenticate(r); err != nil {
+			log.Warnf("Rejected client %s. Err: %s", r.RemoteAddr, err.Error())
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="logbay"`)
+			http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+	}
 
-			if !ok {
-				return nil
+	filter, err := subscription(r.URL.Query(), identity)
+
+	if err != nil {
+		log.Debugf("Rejected client %s. Err: %s", r.RemoteAddr, err.Error())
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	replay, err := parseReplay(r.URL.Query())
+
+	if err != nil {
+		log.Debugf("Rejected client %s. Err: %s", r.RemoteAddr, err.Error())
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	envelope, _ := strconv.ParseBool(r.URL.Query().Get("envelope"))
+
+	c, err := w.upgrader.Upgrade(rw, r, nil)
+
+	if err != nil {
+		log.Errorln("switching protocols:", err)
+		return
+	}
+
+	client := &wsConn{
+		pongReceivedAt: time.Now().UnixNano(),
+		conn:           c,
+		key:            c.RemoteAddr().String(),
+		identity:       identity,
+		envelope:       envelope,
+		queue:          make(chan *websocket.PreparedMessage, w.queueSize),
+		done:           make(chan struct{}),
+	}
+	client.filter.Store(filter)
+
+	c.SetReadLimit(maxClientMessage)
+	c.SetPongHandler(func(string) error {
+		atomic.StoreInt64(&client.pongReceivedAt, time.Now().UnixNano())
+		return nil
+	})
+
+	w.mu.Lock()
+	if replay != nil {
+		for _, record := range replay.records(w.ring, filter) {
+			if m, err := record.prepared(envelope); err == nil {
+				client.replay = append(client.replay, m)
 			}
+		}
+	}
+	w.clients.Store(client.key, client)
+	w.mu.Unlock()
 
-			wsConn.pongReceivedAt = time.Now()
-			w.clients.Store(clientKey, wsConn)
-			return nil
-		})
+	metrics.WSClients.WithLabelValues(w.Name).Inc()
 
-		w.clients.Store(clientKey, &wsConn{
-			conn: c,
-		})
+	if len(client.replay) > 0 {
+		log.Debugf("Replaying %d messages to %s", len(client.replay), client.key)
 	}
 
-	http.HandleFunc(url, h)
-	go http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", port), nil)
+	if filter != nil {
+		log.Infof("Client %s connected. Subscribed to %s", client.key, filter)
+	} else {
+		log.Infof("Client %s connected", client.key)
+	}
+
+	w.mu.Lock()
+	select {
+	case <-w.stop:
+		w.mu.Unlock()
+		w.evict(client, "server shutdown")
+		return
+	default:
+	}
+	w.wg.Add(2)
+	w.mu.Unlock()
+
+	go w.read(client)
+	go w.write(client)
 }
 
-func (w *wsDigest) Consume(msg string) error {
+// Consume queues message for every client without waiting for any of them. clients with full queue
+// miss the message or get disconnected depending on slow client policy
+func (w *wsDigest) Consume(msg *common.Message) error {
 
 	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "wsDigest"))
 
-	m, err := websocket.NewPreparedMessage(websocket.TextMessage, []byte(msg))
+	m, err := websocket.NewPreparedMessage(websocket.TextMessage, msg.Payload)
 
 	if err != nil {
 		log.Debugf("Can't prepare message %v", msg)
 		return err
 	}
 
-	w.messages <- m
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	record := w.ring.add(msg, m)
+	event := &wsEvent{msg: msg}
+
+	w.clients.Range(func(key, value interface{}) bool {
+		c := value.(*wsConn)
+
+		if filter := c.filter.Load().(*wsFilter); filter != nil && !filter.accepts(event) {
+			return true
+		}
+
+		m, err := record.prepared(c.envelope)
+
+		if err != nil {
+			log.Debugf("Can't prepare message %v. Err: %s", msg, err.Error())
+			return true
+		}
+
+		select {
+		case c.queue <- m:
+			return true
+		default:
+		}
+
+		if w.slowClient == common.SlowClientDisconnect {
+			w.evict(c, "client is too slow")
+			return true
+		}
+
+		metrics.WSClientDropped.WithLabelValues(w.Name).Inc()
+		return true
+	})
 
 	return nil
 }
 
-func (w *wsDigest) broadcast() {
+// write sends requested history and then queued messages to client. on shutdown it flushes the queue
+// and says goodbye with close frame
+func (w *wsDigest) write(c *wsConn) {
 
-	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "wsDigest"))
+	defer w.wg.Done()
+
+	for _, m := range c.replay {
+		if !w.send(c, m) {
+			return
+		}
+	}
+
+	c.replay = nil
 
-loop:
 	for {
 		select {
-		case msg, ok := <-w.messages:
+		case m := <-c.queue:
+			if !w.send(c, m) {
+				return
+			}
+			continue
+		case <-c.done:
+			return
+		case <-w.stop:
+		}
 
-			if !ok {
-				break loop
+		for {
+			select {
+			case m := <-c.queue:
+				if !w.send(c, m) {
+					return
+				}
+				continue
+			default:
 			}
 
-			w.clients.Range(func(key, value interface{}) bool {
+			closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown")
+			c.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(WriteTimeout))
+			w.evict(c, "server shutdown")
+			return
+		}
+	}
+}
+
+func (w *wsDigest) send(c *wsConn, m *websocket.PreparedMessage) bool {
 
-				c := value.(*wsConn)
+	c.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
 
-				if err := c.conn.SetWriteDeadline(time.Now().Add(WriteTimeout)); err != nil {
-					log.Errorf("set write deadline failed on %s", c.conn.RemoteAddr().String())
-					return true
-				}
+	err := c.conn.WritePreparedMessage(m)
 
-				if netErr, ok := c.conn.WritePreparedMessage(msg).(net.Error); ok && netErr.Timeout() {
-					log.Errorln("write timeout. addr: ", c.conn.RemoteAddr().String())
-				}
+	if err == nil {
+		return true
+	}
 
-				return true
+	reason := fmt.Sprintf("write failed: %s", err.Error())
 
-			})
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		reason = "write timeout"
+	}
 
-		default:
-			// do nothing
+	w.evict(c, reason)
+	return false
+}
+
+// read processes control frames and subscribe frames of client. client is evicted once connection
+// is closed by either side or subscription is invalid
+func (w *wsDigest) read(c *wsConn) {
+
+	defer w.wg.Done()
+
+	for {
+		_, r, err := c.conn.NextReader()
+
+		if err == nil {
+			var b []byte
+
+			if b, err = ioutil.ReadAll(r); err == nil {
+				err = w.subscribe(c, b)
+			}
+		}
+
+		if err == nil {
+			continue
 		}
+
+		reason := err.Error()
+
+		if closeErr, ok := err.(*websocket.CloseError); ok {
+			reason = fmt.Sprintf("closed by client with code %d %s", closeErr.Code, closeErr.Text)
+		} else if _, ok := err.(*subscribeError); ok {
+			closeMsg := websocket.FormatCloseMessage(websocket.CloseInvalidFramePayloadData, reason)
+			c.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(WriteTimeout))
+		}
+
+		w.evict(c, reason)
+		return
 	}
 }
+
+type subscribeError struct {
+	err error
+}
+
+func (e *subscribeError) Error() string {
+	return fmt.Sprintf("invalid subscription: %s", e.err.Error())
+}
+
+// subscribe replaces client filter with one from subscribe frame like
+// {"fields": {"service": "api"}, "match": "timeout", "severity": "warning"}
+func (w *wsDigest) subscribe(c *wsConn, frame []byte) error {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "wsDigest"))
+
+	s := &wsSubscription{}
+
+	if err := json.Unmarshal(frame, s); err != nil {
+		return &subscribeError{err}
+	}
+
+	if err := s.restrict(c.identity.scope); err != nil {
+		return &subscribeError{err}
+	}
+
+	filter, err := s.compile()
+
+	if err != nil {
+		return &subscribeError{err}
+	}
+
+	c.filter.Store(filter)
+
+	if filter == nil {
+		log.Infof("Client %s subscribed to every message", c.key)
+	} else {
+		log.Infof("Client %s subscribed to %s", c.key, filter)
+	}
+
+	return nil
+}
+
+// ping sends ping to every client each ping interval and evicts ones which haven't answered within pong timeout
+// or whose token has expired
+func (w *wsDigest) ping() {
+
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.stop:
+			return
+		}
+
+		w.clients.Range(func(key, value interface{}) bool {
+			c := value.(*wsConn)
+
+			if time.Since(time.Unix(0, atomic.LoadInt64(&c.pongReceivedAt))) > w.pongTimeout {
+				w.evict(c, "pong timeout")
+				return true
+			}
+
+			if expiresAt := c.identity.expiresAt; !expiresAt.IsZero() && time.Now().After(expiresAt) {
+				closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token expired")
+				c.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(WriteTimeout))
+				w.evict(c, "token expired")
+				return true
+			}
+
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WriteTimeout)); err != nil {
+				w.evict(c, fmt.Sprintf("ping failed: %s", err.Error()))
+			}
+
+			return true
+		})
+	}
+}
+
+// evict closes connection and forgets the client. only the first call for a client has effect
+func (w *wsDigest) evict(c *wsConn, reason string) {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "wsDigest"))
+
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return
+	}
+
+	w.clients.Delete(c.key)
+	close(c.done)
+	c.conn.Close()
+	metrics.WSClients.WithLabelValues(w.Name).Dec()
+
+	log.Infof("Client %s disconnected. Reason: %s", c.key, reason)
+}
@@ -0,0 +1,240 @@
+package digest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"logbay/common"
+)
+
+// wsAuth authenticates upgrade requests with static bearer tokens or JWTs signed with HMAC key
+type wsAuth struct {
+	tokens []wsToken
+	jwtKey []byte
+}
+
+type wsToken struct {
+	token []byte
+	scope map[string]string
+}
+
+// wsIdentity is what client is allowed to see. zero expiresAt means access never expires
+type wsIdentity struct {
+	scope     map[string]string
+	expiresAt time.Time
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+type jwtClaims struct {
+	Exp   *json.Number           `json:"exp"`
+	Nbf   *json.Number           `json:"nbf"`
+	Scope map[string]interface{} `json:"scope"`
+}
+
+var jwtAlgorithms = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+// newWSAuth returns nil if neither tokens nor JWT key is configured
+func newWSAuth(tokens []common.WSToken, jwtKey string) (*wsAuth, error) {
+
+	if len(tokens) == 0 && len(jwtKey) == 0 {
+		return nil, nil
+	}
+
+	a := &wsAuth{}
+
+	for n, t := range tokens {
+		token, err := common.ResolveSecret(t.Token)
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("can't resolve token #%d. Err: %s", n, err.Error()))
+		}
+
+		if len(token) == 0 {
+			return nil, errors.New(fmt.Sprintf("token #%d is empty", n))
+		}
+
+		a.tokens = append(a.tokens, wsToken{[]byte(token), t.Scope})
+	}
+
+	if len(jwtKey) > 0 {
+		key, err := common.ResolveSecret(jwtKey)
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("can't resolve JWT key. Err: %s", err.Error()))
+		}
+
+		a.jwtKey = []byte(key)
+	}
+
+	return a, nil
+}
+
+// authenticate checks token given in Authorization header or token query parameter
+func (a *wsAuth) authenticate(r *http.Request) (*wsIdentity, error) {
+
+	token := r.URL.Query().Get("token")
+
+	if header := r.Header.Get("Authorization"); len(header) > 0 {
+		if !strings.HasPrefix(header, "Bearer ") {
+			return nil, errors.New("unsupported authorization scheme")
+		}
+
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+
+	if len(token) == 0 {
+		return nil, errors.New("token is missing")
+	}
+
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare(t.token, []byte(token)) == 1 {
+			return &wsIdentity{scope: t.scope}, nil
+		}
+	}
+
+	if len(a.jwtKey) > 0 && strings.Count(token, ".") == 2 {
+		return a.verifyJWT(token, time.Now())
+	}
+
+	return nil, errors.New("invalid token")
+}
+
+// verifyJWT checks signature, exp and nbf claims of JWT. scope claim limits messages client can see
+func (a *wsAuth) verifyJWT(token string, now time.Time) (*wsIdentity, error) {
+
+	parts := strings.Split(token, ".")
+
+	header := &jwtHeader{}
+
+	if err := decodeJWTPart(parts[0], header); err != nil {
+		return nil, err
+	}
+
+	algorithm, ok := jwtAlgorithms[header.Alg]
+
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unsupported JWT algorithm %q", header.Alg))
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return nil, errors.New("malformed JWT signature")
+	}
+
+	mac := hmac.New(algorithm, a.jwtKey)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("invalid JWT signature")
+	}
+
+	claims := &jwtClaims{}
+
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return nil, err
+	}
+
+	identity := &wsIdentity{scope: make(map[string]string)}
+
+	if claims.Exp != nil {
+		exp, err := claims.Exp.Int64()
+
+		if err != nil {
+			return nil, errors.New("invalid exp claim")
+		}
+
+		identity.expiresAt = time.Unix(exp, 0)
+
+		if !now.Before(identity.expiresAt) {
+			return nil, errors.New("JWT is expired")
+		}
+	}
+
+	if claims.Nbf != nil {
+		nbf, err := claims.Nbf.Int64()
+
+		if err != nil {
+			return nil, errors.New("invalid nbf claim")
+		}
+
+		if now.Before(time.Unix(nbf, 0)) {
+			return nil, errors.New("JWT is not valid yet")
+		}
+	}
+
+	for field, value := range claims.Scope {
+		s, ok := value.(string)
+
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("scope field %s should be string", field))
+		}
+
+		identity.scope[field] = s
+	}
+
+	return identity, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+
+	b, err := base64.RawURLEncoding.DecodeString(part)
+
+	if err != nil {
+		return errors.New("malformed JWT")
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(b)))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(v); err != nil {
+		return errors.New("malformed JWT")
+	}
+
+	return nil
+}
+
+// checkOrigin allows requests without Origin header and ones coming from allowed origins.
+// "*" allows any origin
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+
+	origins := make(map[string]bool, len(allowed))
+
+	for _, origin := range allowed {
+		origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+
+		if len(origin) == 0 || origins["*"] {
+			return true
+		}
+
+		u, err := url.Parse(origin)
+
+		if err != nil {
+			return false
+		}
+
+		return origins[strings.ToLower(u.Scheme+"://"+u.Host)]
+	}
+}
@@ -0,0 +1,257 @@
+package digest
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"logbay/common"
+)
+
+const testJWTKey = "secret"
+
+// signJWT builds JWT of raw header and claims signed with HMAC algorithm of alg. unknown algorithms
+// get empty signature
+func signJWT(alg, key, header, claims string) string {
+
+	encode := base64.RawURLEncoding.EncodeToString
+	unsigned := encode([]byte(header)) + "." + encode([]byte(claims))
+
+	algorithm, ok := jwtAlgorithms[alg]
+
+	if !ok {
+		return unsigned + "."
+	}
+
+	mac := hmac.New(algorithm, []byte(key))
+	mac.Write([]byte(unsigned))
+
+	return unsigned + "." + encode(mac.Sum(nil))
+}
+
+func TestVerifyJWT(t *testing.T) {
+
+	now := time.Unix(1500000000, 0)
+
+	cases := []struct {
+		name  string
+		token string
+		scope string
+		fails bool
+	}{
+		{"HS256", signJWT("HS256", testJWTKey, `{"alg":"HS256"}`, `{"scope":{"service":"api"}}`), "service=api", false},
+		{"HS384", signJWT("HS384", testJWTKey, `{"alg":"HS384"}`, `{}`), "", false},
+		{"HS512", signJWT("HS512", testJWTKey, `{"alg":"HS512","typ":"JWT"}`, `{"scope":{}}`), "", false},
+		{"wrong key", signJWT("HS256", "other", `{"alg":"HS256"}`, `{}`), "", true},
+		{"algorithm mismatch", signJWT("HS512", testJWTKey, `{"alg":"HS256"}`, `{}`), "", true},
+		{"none algorithm", signJWT("none", testJWTKey, `{"alg":"none"}`, `{}`), "", true},
+		{"lowercase algorithm", signJWT("HS256", testJWTKey, `{"alg":"hs256"}`, `{}`), "", true},
+		{"RSA algorithm", signJWT("RS256", testJWTKey, `{"alg":"RS256"}`, `{}`), "", true},
+		{"missing algorithm", signJWT("HS256", testJWTKey, `{}`, `{}`), "", true},
+		{"malformed header", "!.e30.e30", "", true},
+		{"malformed claims", signJWT("HS256", testJWTKey, `{"alg":"HS256"}`, `{"exp":`), "", true},
+		{"exp in future", signJWT("HS256", testJWTKey, `{"alg":"HS256"}`, `{"exp":1500000001}`), "", false},
+		{"exp now", signJWT("HS256", testJWTKey, `{"alg":"HS256"}`, `{"exp":1500000000}`), "", true},
+		{"exp in past", signJWT("HS256", testJWTKey, `{"alg":"HS256"}`, `{"exp":1400000000}`), "", true},
+		{"fractional exp", signJWT("HS256", testJWTKey, `{"alg":"HS256"}`, `{"exp":1500000001.5}`), "", true},
+		{"nbf now", signJWT("HS256", testJWTKey, `{"alg":"HS256"}`, `{"nbf":1500000000}`), "", false},
+		{"nbf in future", signJWT("HS256", testJWTKey, `{"alg":"HS256"}`, `{"nbf":1500000001}`), "", true},
+		{"numeric scope", signJWT("HS256", testJWTKey, `{"alg":"HS256"}`, `{"scope":{"tenant":1}}`), "", true},
+		{"nested scope", signJWT("HS256", testJWTKey, `{"alg":"HS256"}`, `{"scope":{"tenant":{"id":"a"}}}`), "", true},
+		{"scope of wrong type", signJWT("HS256", testJWTKey, `{"alg":"HS256"}`, `{"scope":"admin"}`), "", true},
+	}
+
+	a := &wsAuth{jwtKey: []byte(testJWTKey)}
+
+	for _, c := range cases {
+		identity, err := a.verifyJWT(c.token, now)
+
+		if c.fails != (err != nil) {
+			t.Errorf("%s: unexpected result %v", c.name, err)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		scope := ""
+
+		for field, value := range identity.scope {
+			scope += field + "=" + value
+		}
+
+		if scope != c.scope {
+			t.Errorf("%s: unexpected scope %q", c.name, scope)
+		}
+	}
+}
+
+func TestVerifyJWTTamperedClaims(t *testing.T) {
+
+	token := signJWT("HS256", testJWTKey, `{"alg":"HS256"}`, `{"scope":{"service":"api"}}`)
+	forged := signJWT("HS256", testJWTKey, `{"alg":"HS256"}`, `{}`)
+
+	// claims of one token with signature of another
+	parts := strings.Split(token, ".")
+	parts[2] = strings.Split(forged, ".")[2]
+
+	a := &wsAuth{jwtKey: []byte(testJWTKey)}
+
+	if _, err := a.verifyJWT(strings.Join(parts, "."), time.Now()); err == nil {
+		t.Error("Expected token with tampered claims to be rejected")
+	}
+}
+
+func TestVerifyJWTExpiresAt(t *testing.T) {
+
+	a := &wsAuth{jwtKey: []byte(testJWTKey)}
+
+	identity, err := a.verifyJWT(signJWT("HS256", testJWTKey, `{"alg":"HS256"}`, `{"exp":1500000100}`), time.Unix(1500000000, 0))
+
+	if err != nil {
+		t.Fatalf("Can't verify JWT. Err: %s", err.Error())
+	}
+
+	if !identity.expiresAt.Equal(time.Unix(1500000100, 0)) {
+		t.Errorf("Unexpected expiration %s", identity.expiresAt)
+	}
+
+	identity, _ = a.verifyJWT(signJWT("HS256", testJWTKey, `{"alg":"HS256"}`, `{}`), time.Now())
+
+	if !identity.expiresAt.IsZero() {
+		t.Errorf("Expected JWT without exp never to expire, got %s", identity.expiresAt)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+
+	a, err := newWSAuth([]common.WSToken{{Token: "static", Scope: map[string]string{"service": "api"}}}, testJWTKey)
+
+	if err != nil {
+		t.Fatalf("Can't create auth. Err: %s", err.Error())
+	}
+
+	jwt := signJWT("HS256", testJWTKey, `{"alg":"HS256"}`, `{"scope":{"service":"db"}}`)
+
+	cases := []struct {
+		name   string
+		query  string
+		header string
+		scope  string
+		fails  bool
+	}{
+		{"static token in header", "", "Bearer static", "api", false},
+		{"static token in query", "token=static", "", "api", false},
+		{"JWT in header", "", "Bearer " + jwt, "db", false},
+		{"JWT in query", "token=" + url.QueryEscape(jwt), "", "db", false},
+		{"header wins over query", "token=static", "Bearer unknown", "", true},
+		{"unknown token", "token=unknown", "", "", true},
+		{"missing token", "", "", "", true},
+		{"basic auth", "", "Basic c3RhdGljOg==", "", true},
+		{"JWT signed with other key", "", "Bearer " + signJWT("HS256", "other", `{"alg":"HS256"}`, `{}`), "", true},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/logbay?"+c.query, nil)
+
+		if len(c.header) > 0 {
+			r.Header.Set("Authorization", c.header)
+		}
+
+		identity, err := a.authenticate(r)
+
+		if c.fails != (err != nil) {
+			t.Errorf("%s: unexpected result %v", c.name, err)
+			continue
+		}
+
+		if err == nil && identity.scope["service"] != c.scope {
+			t.Errorf("%s: unexpected scope %v", c.name, identity.scope)
+		}
+	}
+}
+
+func TestSubscriptionScope(t *testing.T) {
+
+	identity := &wsIdentity{scope: map[string]string{"service": "api"}}
+
+	cases := []struct {
+		query  string
+		fields map[string]string
+		fails  bool
+	}{
+		{"", map[string]string{"service": "api"}, false},
+		{"field=service:api", map[string]string{"service": "api"}, false},
+		{"field=level:error", map[string]string{"service": "api", "level": "error"}, false},
+		// client can't widen or move scope given by token
+		{"field=service:db", nil, true},
+		{"field=service:", nil, true},
+		{"field=service:api&field=service:db", nil, true},
+	}
+
+	for _, c := range cases {
+		query, _ := url.ParseQuery(c.query)
+		filter, err := subscription(query, identity)
+
+		if c.fails != (err != nil) {
+			t.Errorf("Unexpected result for %q: %v", c.query, err)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if len(filter.fields) != len(c.fields) {
+			t.Errorf("Unexpected fields for %q: %v", c.query, filter.fields)
+		}
+
+		for field, value := range c.fields {
+			if filter.fields[field] != value {
+				t.Errorf("Unexpected fields for %q: %v", c.query, filter.fields)
+			}
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+
+	cases := []struct {
+		allowed []string
+		origin  string
+		ok      bool
+	}{
+		{[]string{"https://example.com"}, "", true},
+		{[]string{"https://example.com"}, "https://example.com", true},
+		{[]string{"https://Example.com/"}, "https://example.com", true},
+		{[]string{"https://example.com"}, "HTTPS://EXAMPLE.COM", true},
+		{[]string{"https://example.com"}, "https://example.com/path", true},
+		{[]string{"https://example.com"}, "http://example.com", false},
+		{[]string{"https://example.com"}, "https://example.com:8443", false},
+		{[]string{"https://example.com"}, "https://example.com.evil.io", false},
+		{[]string{"https://example.com"}, "https://evil.io/https://example.com", false},
+		{[]string{"https://example.com"}, "null", false},
+		{[]string{"https://example.com"}, "://", false},
+		{[]string{"https://example.com:8443"}, "https://example.com:8443", true},
+		{[]string{"*"}, "https://evil.io", true},
+		{nil, "https://example.com", false},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/logbay", nil)
+
+		if len(c.origin) > 0 {
+			r.Header.Set("Origin", c.origin)
+		}
+
+		if ok := checkOrigin(c.allowed)(r); ok != c.ok {
+			t.Errorf("Unexpected result for origin %q allowed by %v: %v", c.origin, c.allowed, ok)
+		}
+	}
+}
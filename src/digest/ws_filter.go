@@ -0,0 +1,226 @@
+package digest
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"logbay/common"
+	"logbay/template"
+)
+
+// severities maps level names to syslog severity. lower is more severe
+var severities = map[string]int{
+	"emerg":       0,
+	"emergency":   0,
+	"panic":       0,
+	"alert":       1,
+	"crit":        2,
+	"critical":    2,
+	"fatal":       2,
+	"err":         3,
+	"error":       3,
+	"warn":        4,
+	"warning":     4,
+	"notice":      5,
+	"info":        6,
+	"information": 6,
+	"debug":       7,
+	"trace":       7,
+}
+
+// severityFields are payload fields message severity is taken from, in order of preference
+var severityFields = []string{"severity", "level"}
+
+// wsSubscription is filter requested by client in subscribe frame. empty subscription matches every message
+type wsSubscription struct {
+	Fields   map[string]string `json:"fields"`
+	Match    string            `json:"match"`
+	Severity string            `json:"severity"`
+}
+
+// wsFilter accepts messages having every field equal to the expected value, payload matching
+// regular expression and severity at least as high as the minimal one
+type wsFilter struct {
+	source   string
+	fields   map[string]string
+	match    *regexp.Regexp
+	severity int
+}
+
+// parseQuery reads subscription from upgrade request query like
+// ?field=service:api&field=kubernetes.namespace:prod&match=timeout&severity=warning
+func parseQuery(query url.Values) (*wsSubscription, error) {
+
+	s := &wsSubscription{
+		Fields:   make(map[string]string),
+		Match:    query.Get("match"),
+		Severity: query.Get("severity"),
+	}
+
+	for _, field := range query["field"] {
+		sep := strings.IndexByte(field, ':')
+
+		if sep <= 0 {
+			return nil, errors.New(fmt.Sprintf("invalid field filter %q. expected path:value", field))
+		}
+
+		s.Fields[field[:sep]] = field[sep+1:]
+	}
+
+	return s, nil
+}
+
+// restrict adds fields of token scope to subscription. subscription to other values of them is refused
+func (s *wsSubscription) restrict(scope map[string]string) error {
+
+	if len(scope) == 0 {
+		return nil
+	}
+
+	if s.Fields == nil {
+		s.Fields = make(map[string]string)
+	}
+
+	for field, value := range scope {
+		if requested, ok := s.Fields[field]; ok && requested != value {
+			return errors.New(fmt.Sprintf("subscription to %s=%s is not allowed", field, requested))
+		}
+
+		s.Fields[field] = value
+	}
+
+	return nil
+}
+
+func (s *wsSubscription) compile() (*wsFilter, error) {
+
+	f := &wsFilter{
+		fields:   s.Fields,
+		severity: -1,
+	}
+
+	var conditions []string
+
+	for path, value := range s.Fields {
+		conditions = append(conditions, fmt.Sprintf("%s=%s", path, value))
+	}
+
+	sort.Strings(conditions)
+
+	if len(s.Match) > 0 {
+		match, err := regexp.Compile(s.Match)
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid match expression %q. Err: %s", s.Match, err.Error()))
+		}
+
+		f.match = match
+		conditions = append(conditions, fmt.Sprintf("match=%s", s.Match))
+	}
+
+	if len(s.Severity) > 0 {
+		severity, ok := parseSeverity(s.Severity)
+
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("invalid severity %q", s.Severity))
+		}
+
+		f.severity = severity
+		conditions = append(conditions, fmt.Sprintf("severity=%s", s.Severity))
+	}
+
+	if len(conditions) == 0 {
+		return nil, nil
+	}
+
+	f.source = strings.Join(conditions, " ")
+
+	return f, nil
+}
+
+func (f *wsFilter) String() string {
+	return f.source
+}
+
+func (f *wsFilter) accepts(e *wsEvent) bool {
+
+	for path, expected := range f.fields {
+		if value, ok := e.field(path); !ok || value != expected {
+			return false
+		}
+	}
+
+	if f.match != nil && !f.match.Match(e.msg.Payload) {
+		return false
+	}
+
+	if f.severity >= 0 {
+		severity, ok := e.severity()
+
+		if !ok || severity > f.severity {
+			return false
+		}
+	}
+
+	return true
+}
+
+// wsEvent decodes message payload once for all clients and only if some filter needs fields
+type wsEvent struct {
+	msg     *common.Message
+	doc     interface{}
+	decoded bool
+}
+
+func (e *wsEvent) field(path string) (string, bool) {
+
+	if !e.decoded && !strings.HasPrefix(path, "@") {
+		e.doc = template.Decode(e.msg.Payload)
+		e.decoded = true
+	}
+
+	return template.Lookup(e.msg, e.doc, path)
+}
+
+func (e *wsEvent) severity() (int, bool) {
+
+	for _, path := range severityFields {
+		if value, ok := e.field(path); ok {
+			return parseSeverity(value)
+		}
+	}
+
+	return 0, false
+}
+
+// parseSeverity accepts level names and syslog severity numbers
+func parseSeverity(value string) (int, bool) {
+
+	if n, err := strconv.Atoi(value); err == nil {
+		return n, n >= 0 && n <= 7
+	}
+
+	n, ok := severities[strings.ToLower(value)]
+	return n, ok
+}
+
+// subscription compiles filter from upgrade request query limited to identity scope
+func subscription(query url.Values, identity *wsIdentity) (*wsFilter, error) {
+
+	s, err := parseQuery(query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.restrict(identity.scope); err != nil {
+		return nil, err
+	}
+
+	return s.compile()
+}
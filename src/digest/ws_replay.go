@@ -0,0 +1,157 @@
+package digest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+
+	"logbay/common"
+)
+
+// wsRecord is message numbered by websocket digest. enveloped form is prepared once some client asks for it
+type wsRecord struct {
+	seq       uint64
+	msg       *common.Message
+	raw       *websocket.PreparedMessage
+	enveloped *websocket.PreparedMessage
+}
+
+// wsEnvelope tells client sequence ID of message so it can resume from it after reconnect
+type wsEnvelope struct {
+	Seq     uint64          `json:"seq"`
+	Message json.RawMessage `json:"message"`
+}
+
+// prepared returns message as sent to client. callers hold digest lock
+func (r *wsRecord) prepared(envelope bool) (*websocket.PreparedMessage, error) {
+
+	if !envelope {
+		return r.raw, nil
+	}
+
+	if r.enveloped != nil {
+		return r.enveloped, nil
+	}
+
+	payload := r.msg.Payload
+
+	// payloads which aren't JSON are embedded as strings
+	if !json.Valid(payload) {
+		payload, _ = json.Marshal(string(payload))
+	}
+
+	b, err := json.Marshal(&wsEnvelope{Seq: r.seq, Message: payload})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if r.enveloped, err = websocket.NewPreparedMessage(websocket.TextMessage, b); err != nil {
+		return nil, err
+	}
+
+	return r.enveloped, nil
+}
+
+// wsRing numbers messages and keeps the most recent of them. it isn't safe for concurrent use
+type wsRing struct {
+	records []*wsRecord
+	next    int
+	full    bool
+	seq     uint64
+}
+
+func newWSRing(capacity int) *wsRing {
+	return &wsRing{records: make([]*wsRecord, capacity)}
+}
+
+func (r *wsRing) add(msg *common.Message, raw *websocket.PreparedMessage) *wsRecord {
+
+	r.seq++
+	record := &wsRecord{seq: r.seq, msg: msg, raw: raw}
+
+	if len(r.records) == 0 {
+		return record
+	}
+
+	r.records[r.next] = record
+	r.next = (r.next + 1) % len(r.records)
+	r.full = r.full || r.next == 0
+
+	return record
+}
+
+// all returns kept records from the oldest to the newest
+func (r *wsRing) all() []*wsRecord {
+
+	if !r.full {
+		return append([]*wsRecord(nil), r.records[:r.next]...)
+	}
+
+	return append(append([]*wsRecord(nil), r.records[r.next:]...), r.records[:r.next]...)
+}
+
+// wsReplay is history client asks for on connect: last N messages or ones after given sequence ID
+type wsReplay struct {
+	last     int
+	after    uint64
+	hasAfter bool
+}
+
+// parseReplay reads ?last=N or ?after=SEQ of upgrade request. nil means client wants no history
+func parseReplay(query url.Values) (*wsReplay, error) {
+
+	last, after := query.Get("last"), query.Get("after")
+
+	switch {
+	case len(last) > 0 && len(after) > 0:
+		return nil, errors.New("last and after can't be used together")
+	case len(last) > 0:
+		n, err := strconv.Atoi(last)
+
+		if err != nil || n < 0 {
+			return nil, errors.New(fmt.Sprintf("invalid last %q", last))
+		}
+
+		return &wsReplay{last: n}, nil
+	case len(after) > 0:
+		seq, err := strconv.ParseUint(after, 10, 64)
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid after %q", after))
+		}
+
+		return &wsReplay{after: seq, hasAfter: true}, nil
+	}
+
+	return nil, nil
+}
+
+// records selects history matching filter. sequence ID from the future means digest has been restarted
+// since client saw it, so everything kept is replayed
+func (p *wsReplay) records(ring *wsRing, filter *wsFilter) []*wsRecord {
+
+	var selected []*wsRecord
+
+	for _, record := range ring.all() {
+		if p.hasAfter && p.after <= ring.seq && record.seq <= p.after {
+			continue
+		}
+
+		if filter != nil && !filter.accepts(&wsEvent{msg: record.msg}) {
+			continue
+		}
+
+		selected = append(selected, record)
+	}
+
+	if !p.hasAfter && len(selected) > p.last {
+		selected = selected[len(selected)-p.last:]
+	}
+
+	return selected
+}
@@ -0,0 +1,278 @@
+package ingest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"logbay/common"
+)
+
+const (
+	maxFrameSize = 10 << 20
+	// multilineFlush is how long multiline framer waits for continuation of the last line received
+	multilineFlush = 500 * time.Millisecond
+	// defaultMultiline joins indented lines and "Caused by:" lines of stack traces
+	defaultMultiline = `^(\s|Caused by:)`
+)
+
+// framer reads next message from connection. if err is set, frame holds bytes read before the error
+// which may be worth delivering
+type framer func(r *frameReader) (frame []byte, err error)
+
+// frameReader buffers connection for framers
+type frameReader struct {
+	*bufio.Reader
+	conn *connReader
+}
+
+func newFrameReader(conn *connReader) *frameReader {
+	return &frameReader{Reader: bufio.NewReader(conn), conn: conn}
+}
+
+// more tells if there is data to read available within wait
+func (r *frameReader) more(wait time.Duration) bool {
+
+	if r.Buffered() > 0 {
+		return true
+	}
+
+	r.conn.wait = wait
+	_, err := r.Peek(1)
+	r.conn.wait = 0
+
+	return err == nil
+}
+
+// newFraming returns constructor of per-connection framers for given mode
+func newFraming(mode common.Framing, delimiter byte, pattern string) (func() framer, error) {
+
+	switch mode {
+	case "", common.FramingDelimiter:
+		return func() framer { return delimited(delimiter, maxFrameSize) }, nil
+	case common.FramingLengthPrefix:
+		return func() framer { return lengthPrefixed() }, nil
+	case common.FramingOctetCounting:
+		return func() framer { return octetCounted(maxFrameSize) }, nil
+	case common.FramingMultiline:
+		if len(pattern) == 0 {
+			pattern = defaultMultiline
+		}
+
+		continuation, err := regexp.Compile(pattern)
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid multiline pattern %q. Err: %s", pattern, err.Error()))
+		}
+
+		return func() framer { return multiline(delimiter, continuation) }, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("invalid framing %s", mode))
+}
+
+// delimited reads messages terminated by delimiter. messages longer than limit fail the connection
+func delimited(delimiter byte, limit int) framer {
+	return func(r *frameReader) ([]byte, error) {
+		var b []byte
+
+		for {
+			chunk, err := r.ReadSlice(delimiter)
+
+			// delimiter doesn't count
+			if len(b)+len(chunk) > limit+1 {
+				return nil, errors.New(fmt.Sprintf("frame exceeds %d bytes", limit))
+			}
+
+			b = append(b, chunk...)
+
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+
+			if err != nil {
+				return b, err
+			}
+
+			return b[:len(b)-1], nil
+		}
+	}
+}
+
+// lengthPrefixed reads messages prefixed with 4-byte big-endian length
+func lengthPrefixed() framer {
+	return func(r *frameReader) ([]byte, error) {
+		header := make([]byte, 4)
+
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return nil, err
+		}
+
+		length := binary.BigEndian.Uint32(header)
+
+		if length > maxFrameSize {
+			return nil, errors.New(fmt.Sprintf("invalid frame length %d", length))
+		}
+
+		return readFrame(r, int(length))
+	}
+}
+
+// octetCounted reads messages prefixed with decimal length and space (RFC 6587). messages longer than
+// limit fail the connection
+func octetCounted(limit int) framer {
+
+	// header can't be longer than decimal limit
+	digits := len(strconv.Itoa(limit))
+
+	return func(r *frameReader) ([]byte, error) {
+		header := make([]byte, 0, digits)
+
+		for {
+			c, err := r.ReadByte()
+
+			if err != nil {
+				return nil, err
+			}
+
+			if c == ' ' {
+				break
+			}
+
+			if len(header) == digits {
+				return nil, errors.New(fmt.Sprintf("invalid frame length %q", append(header, c)))
+			}
+
+			header = append(header, c)
+		}
+
+		length, err := strconv.Atoi(string(header))
+
+		if err != nil || length < 0 || length > limit {
+			return nil, errors.New(fmt.Sprintf("invalid frame length %q", header))
+		}
+
+		return readFrame(r, length)
+	}
+}
+
+// multiline reads lines terminated by delimiter and joins ones matching continuation to the line
+// before them. message is complete once next line doesn't match or nothing arrives within multilineFlush
+func multiline(delimiter byte, continuation *regexp.Regexp) framer {
+
+	line := delimited(delimiter, maxFrameSize)
+	var pending []byte
+
+	return func(r *frameReader) ([]byte, error) {
+		event := pending
+		pending = nil
+
+		if event == nil {
+			b, err := line(r)
+
+			if err != nil {
+				return b, err
+			}
+
+			event = b
+		}
+
+		for len(event) < maxFrameSize && r.more(multilineFlush) {
+			b, err := line(r)
+
+			if continuation.Match(b) {
+				event = append(append(event, delimiter), b...)
+			} else if len(b) > 0 {
+				// the line starts next message
+				pending = b
+				return event, nil
+			}
+
+			if err != nil {
+				return event, err
+			}
+		}
+
+		return event, nil
+	}
+}
+
+// syslogFraming detects framing of every message: octet counting if it starts with digit,
+// non-transparent framing with delimiter otherwise (RFC 6587). either is limited to maxSize
+func syslogFraming(delimiter byte, maxSize int) framer {
+
+	counted := octetCounted(maxSize)
+	delimited := delimited(delimiter, maxSize)
+
+	return func(r *frameReader) ([]byte, error) {
+		first, err := r.Peek(1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if first[0] >= '0' && first[0] <= '9' {
+			return counted(r)
+		}
+
+		return delimited(r)
+	}
+}
+
+func readFrame(r io.Reader, length int) ([]byte, error) {
+
+	frame := make([]byte, length)
+
+	if _, err := io.ReadFull(r, frame); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+// connReader waits for data through idle timeouts, so framers never see a frame interrupted
+// by one. reads fail once ingest is stopping, or after wait if it is set
+type connReader struct {
+	i    *streamIngest
+	conn net.Conn
+	wait time.Duration
+}
+
+func (c *connReader) Read(p []byte) (int, error) {
+
+	timeout := readTimeout
+
+	if c.wait > 0 {
+		timeout = c.wait
+	}
+
+	for {
+		// deadline is set under lock so it can't override the one set by Stop
+		c.i.mu.Lock()
+		if atomic.LoadInt32(&c.i.stopping) == 0 {
+			c.conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		c.i.mu.Unlock()
+
+		n, err := c.conn.Read(p)
+
+		if netErr, ok := err.(net.Error); ok && n == 0 && netErr.Timeout() && c.wait == 0 && atomic.LoadInt32(&c.i.stopping) == 0 {
+			continue
+		}
+
+		return n, err
+	}
+}
@@ -0,0 +1,163 @@
+package ingest
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"logbay/common"
+)
+
+// readFrames reads frames of input until framer fails and returns them along with the error
+func readFrames(frame framer, r *frameReader) ([]string, error) {
+
+	var frames []string
+
+	for {
+		b, err := frame(r)
+
+		if err != nil {
+			if len(b) > 0 {
+				frames = append(frames, string(b))
+			}
+			return frames, err
+		}
+
+		frames = append(frames, string(b))
+	}
+}
+
+// pipeFrameReader returns frameReader of one end of connection and the other end to write to
+func pipeFrameReader() (*frameReader, net.Conn) {
+	server, client := net.Pipe()
+	return newFrameReader(&connReader{i: &streamIngest{}, conn: server}), client
+}
+
+func TestFraming(t *testing.T) {
+
+	cases := []struct {
+		framing common.Framing
+		input   string
+		frames  []string
+		fails   bool
+	}{
+		{common.FramingDelimiter, "one\ntwo\n", []string{"one", "two"}, false},
+		{common.FramingLengthPrefix, "\x00\x00\x00\x03one\x00\x00\x00\x00", []string{"one", ""}, false},
+		{common.FramingLengthPrefix, "\x00\x00\x00\x05one", nil, false},
+		{common.FramingLengthPrefix, "\x00\x00", nil, false},
+		{common.FramingLengthPrefix, "\x01\x00\x00\x00one", nil, true},
+		{common.FramingOctetCounting, "3 one4 two\n", []string{"one", "two\n"}, false},
+		{common.FramingOctetCounting, "9 one", nil, false},
+		{common.FramingOctetCounting, "x one", nil, true},
+		{common.FramingOctetCounting, "-1 one", nil, true},
+		{common.FramingOctetCounting, "99999999 one", nil, true},
+		{common.FramingOctetCounting, "123456789", nil, true},
+	}
+
+	for _, c := range cases {
+		framing, err := newFraming(c.framing, '\n', "")
+
+		if err != nil {
+			t.Fatalf("Can't create %s framing. Err: %s", c.framing, err.Error())
+		}
+
+		frames, err := readFrames(framing(), &frameReader{Reader: bufio.NewReaderSize(strings.NewReader(c.input), 16)})
+
+		if strings.Join(frames, "|") != strings.Join(c.frames, "|") {
+			t.Errorf("Unexpected %s frames of %q: %q", c.framing, c.input, frames)
+		}
+
+		// truncated frames end with EOF like closed connection does
+		if c.fails != (err != io.EOF) {
+			t.Errorf("Unexpected %s error for %q: %v", c.framing, c.input, err)
+		}
+	}
+}
+
+func TestOctetCountingHeaderLimit(t *testing.T) {
+
+	framing, _ := newFraming(common.FramingOctetCounting, '\n', "")
+	digits := &countingReader{Reader: strings.NewReader(strings.Repeat("1", 1<<20))}
+
+	_, err := framing()(&frameReader{Reader: bufio.NewReaderSize(digits, 16)})
+
+	if err == nil || err == io.EOF || digits.n > 64 {
+		t.Errorf("Expected long length header to fail the frame, read %d bytes: %v", digits.n, err)
+	}
+}
+
+func TestMultilineFraming(t *testing.T) {
+
+	cases := []struct {
+		input  string
+		frames []string
+	}{
+		{"one\ntwo\n", []string{"one", "two"}},
+		{"error\n\tat main\n\tat init\nnext\n", []string{"error\n\tat main\n\tat init", "next"}},
+		{"error\nCaused by: io\n  at read\nCaused by: eof\n", []string{"error\nCaused by: io\n  at read\nCaused by: eof"}},
+		// continuation of last line is kept without trailing delimiter
+		{"error\n\tat main", []string{"error\n\tat main"}},
+		// continuation without line before it is a message of its own
+		{"\tat main\nnext\n", []string{"\tat main", "next"}},
+	}
+
+	for _, c := range cases {
+		r, w := pipeFrameReader()
+
+		go func(input string) {
+			io.WriteString(w, input)
+			w.Close()
+		}(c.input)
+
+		framing, _ := newFraming(common.FramingMultiline, '\n', "")
+		frames, err := readFrames(framing(), r)
+
+		if strings.Join(frames, "|") != strings.Join(c.frames, "|") || err != io.EOF {
+			t.Errorf("Unexpected frames of %q: %q, %v", c.input, frames, err)
+		}
+	}
+}
+
+func TestMultilineFramingFlush(t *testing.T) {
+
+	r, w := pipeFrameReader()
+	defer w.Close()
+
+	framing, _ := newFraming(common.FramingMultiline, '\n', `^\s`)
+	frame := framing()
+
+	go io.WriteString(w, "error\n\tat main\n")
+
+	// message is complete once nothing arrives within multilineFlush
+	start := time.Now()
+	b, err := frame(r)
+
+	if string(b) != "error\n\tat main" || err != nil {
+		t.Fatalf("Unexpected frame %q, %v", b, err)
+	}
+
+	if waited := time.Since(start); waited < multilineFlush {
+		t.Errorf("Expected frame to be flushed after %s, got it after %s", multilineFlush, waited)
+	}
+
+	// next line starts new message after the flush, it isn't joined with the previous one
+	go io.WriteString(w, "\tat init\nnext\n")
+
+	b, err = frame(r)
+
+	if string(b) != "\tat init" || err != nil {
+		t.Fatalf("Unexpected frame %q, %v", b, err)
+	}
+
+	// the line which ended previous message is returned as the next one
+	go w.Close()
+
+	b, err = frame(r)
+
+	if string(b) != "next" || err != nil {
+		t.Errorf("Unexpected pending frame %q, %v", b, err)
+	}
+}
@@ -0,0 +1,306 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	random "math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"logbay/common"
+)
+
+const (
+	maxRequestBodySize = 10 << 20
+	httpsHeaderTimeout = 10 * time.Second
+	httpsReadTimeout   = time.Minute
+	httpsIdleTimeout   = 2 * time.Minute
+)
+
+type httpsConf struct {
+	Bind       string
+	Port       int
+	Endpoint   string
+	Cert       string
+	Key        string
+	CA         string
+	ClientAuth common.ClientAuth
+	AllowedCN  []string
+	AllowedSAN []string
+	Delimiter  byte
+	Buffer     int
+	Overflow   overflowConf
+}
+
+type httpsIngest struct {
+	common.IngestPoint
+	out       *outbox
+	delimiter byte
+	server    *http.Server
+	listener  net.Listener
+	certs     *common.CertReloader
+	allowed   *common.AllowList
+}
+
+func NewHTTPSIngest(name string, conf *httpsConf) (common.Messenger, error) {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "httpsIngest"))
+
+	if conf.Port == 0 {
+		log.Warnf("HTTPS port should be > 0")
+		return nil, errors.New("invalid port 0")
+	}
+
+	if len(conf.Endpoint) == 0 {
+		log.Debugln("Endpoint is not configured. Using /logbay")
+		conf.Endpoint = "/logbay"
+	}
+
+	if conf.Endpoint[0] != '/' {
+		conf.Endpoint = fmt.Sprintf("/%s", conf.Endpoint)
+	}
+
+	if conf.Delimiter == 0 {
+		log.Infof("Delimiter is not configured. Using '\\n'")
+		conf.Delimiter = '\n'
+	}
+
+	if len(name) == 0 {
+		name = fmt.Sprintf("https-ingest#%d", random.Int())
+	}
+
+	if conf.Buffer == 0 {
+		conf.Buffer = 50
+	}
+
+	if len(conf.Bind) == 0 {
+		conf.Bind = "0.0.0.0"
+	}
+
+	tlsConfig, certs, err := common.ServerTLS(&common.ServerTLSConfig{
+		Cert:       conf.Cert,
+		Key:        conf.Key,
+		CA:         conf.CA,
+		ClientAuth: conf.ClientAuth,
+		AllowedCN:  conf.AllowedCN,
+		AllowedSAN: conf.AllowedSAN,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make(chan *common.Message, conf.Buffer)
+	out, err := newOutbox(name, msg, &conf.Overflow)
+
+	if err != nil {
+		return nil, err
+	}
+
+	point := &httpsIngest{
+		IngestPoint: common.IngestPoint{
+			Name: name,
+			Type: common.IngestHTTPS,
+			Msg:  msg,
+		},
+		out:       out,
+		delimiter: conf.Delimiter,
+		certs:     certs,
+		allowed:   common.NewAllowList(conf.AllowedCN, conf.AllowedSAN),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(conf.Endpoint, point.handle)
+
+	point.server = &http.Server{
+		Addr:              net.JoinHostPort(conf.Bind, strconv.Itoa(conf.Port)),
+		Handler:           mux,
+		ReadHeaderTimeout: httpsHeaderTimeout,
+		ReadTimeout:       httpsReadTimeout,
+		IdleTimeout:       httpsIdleTimeout,
+		TLSConfig:         tlsConfig,
+	}
+
+	return point, nil
+}
+
+func (i *httpsIngest) Start() error {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "httpsIngest"))
+
+	listener, err := tls.Listen("tcp", i.server.Addr, i.server.TLSConfig)
+
+	if err != nil {
+		log.Errorf("Failed to start server. Err: %s", err.Error())
+		return err
+	}
+
+	i.listener = listener
+
+	log.Infof("Listening for incoming HTTPS requests on %s", i.server.Addr)
+
+	go i.certs.Watch()
+
+	go func() {
+		if err := i.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("HTTPS server stopped. Err: %s", err.Error())
+		}
+	}()
+
+	return nil
+}
+
+// Stop waits for in-flight requests to be handled before closing messages channel
+func (i *httpsIngest) Stop(ctx context.Context) error {
+
+	err := i.server.Shutdown(ctx)
+
+	if i.listener != nil {
+		i.certs.Close()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return i.out.close(ctx)
+}
+
+func (i *httpsIngest) Messages() chan *common.Message {
+	return i.Msg
+}
+
+func (i *httpsIngest) handle(rw http.ResponseWriter, r *http.Request) {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "httpsIngest"))
+
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	identity, err := clientIdentity(r.TLS, i.allowed)
+
+	if err != nil {
+		log.Warnf("Rejected client %s. Err: %s", r.RemoteAddr, err.Error())
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, maxRequestBodySize))
+
+	if err != nil {
+		log.Debugf("Can't read request body from %s. Err: %s", r.RemoteAddr, err.Error())
+		http.Error(rw, "can't read request body", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	messages, err := splitBody(body, i.delimiter, contentType == "application/json")
+
+	if err != nil {
+		log.Debugf("Malformed request body from %s. Err: %s", r.RemoteAddr, err.Error())
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dropped := 0
+
+	for _, b := range messages {
+		msg := common.NewMessage(b, r.RemoteAddr)
+
+		if len(identity) > 0 {
+			msg.Meta = make(map[string]string, len(identity))
+			for k, v := range identity {
+				msg.Meta[k] = v
+			}
+		}
+
+		if !i.out.write(msg) {
+			dropped++
+		}
+	}
+
+	// let client retry instead of pretending dropped messages are accepted
+	if dropped > 0 {
+		log.Debugf("%d of %d messages from %s are dropped", dropped, len(messages), r.RemoteAddr)
+		rw.Header().Set("Retry-After", "1")
+		http.Error(rw, "buffer is full", http.StatusServiceUnavailable)
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// splitBody turns request body into separate messages. JSON array elements become messages on their own,
+// otherwise body is split by delimiter. Single-line body is a batch of one. body starting with [ which
+// isn't JSON array is rejected only if it is sent as JSON, lines like "[INFO] started" are messages otherwise
+func splitBody(body []byte, delim byte, isJSON bool) ([][]byte, error) {
+
+	trimmed := bytes.TrimSpace(body)
+
+	if len(trimmed) == 0 {
+		return nil, nil
+	}
+
+	var items []json.RawMessage
+
+	if trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			if isJSON {
+				return nil, errors.New(fmt.Sprintf("invalid JSON array: %s", err.Error()))
+			}
+
+			items = nil
+		}
+	}
+
+	if items != nil {
+		messages := make([][]byte, 0, len(items))
+
+		for _, item := range items {
+			var s string
+
+			// plain strings are unquoted, everything else goes as compact JSON
+			if err := json.Unmarshal(item, &s); err == nil {
+				if len(s) > 0 {
+					messages = append(messages, []byte(s))
+				}
+				continue
+			}
+
+			var buf bytes.Buffer
+
+			if err := json.Compact(&buf, item); err != nil {
+				return nil, err
+			}
+
+			messages = append(messages, buf.Bytes())
+		}
+
+		return messages, nil
+	}
+
+	messages := make([][]byte, 0)
+
+	for _, line := range bytes.Split(trimmed, []byte{delim}) {
+		line = bytes.TrimRight(line, "\r")
+
+		if len(line) == 0 {
+			continue
+		}
+
+		messages = append(messages, line)
+	}
+
+	return messages, nil
+}
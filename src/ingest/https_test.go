@@ -0,0 +1,200 @@
+package ingest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"logbay/common"
+)
+
+func TestSplitBody(t *testing.T) {
+
+	cases := []struct {
+		body     string
+		isJSON   bool
+		messages []string
+		fails    bool
+	}{
+		{"", false, nil, false},
+		{"  \n ", false, nil, false},
+		{"service started", false, []string{"service started"}, false},
+		{"one\r\ntwo\n\nthree\n", false, []string{"one", "two", "three"}, false},
+		{`{"level":"info"}`, true, []string{`{"level":"info"}`}, false},
+		{`["one", {"level": "info"}, 3, ""]`, false, []string{"one", `{"level":"info"}`, "3"}, false},
+		{` ["one"] `, true, []string{"one"}, false},
+		{"[]", true, nil, false},
+		// bracketed lines aren't JSON unless client says so
+		{"[INFO] service started", false, []string{"[INFO] service started"}, false},
+		{"[2019-07-01 10:00:00] one\n[2019-07-01 10:00:01] two", false, []string{"[2019-07-01 10:00:00] one", "[2019-07-01 10:00:01] two"}, false},
+		{`["one"]` + "\n" + `["two"]`, false, []string{`["one"]`, `["two"]`}, false},
+		{"[INFO] service started", true, nil, true},
+		{`["one",`, true, nil, true},
+	}
+
+	for _, c := range cases {
+		messages, err := splitBody([]byte(c.body), '\n', c.isJSON)
+
+		if c.fails != (err != nil) {
+			t.Errorf("Unexpected error for %q: %v", c.body, err)
+			continue
+		}
+
+		got := make([]string, len(messages))
+
+		for n, m := range messages {
+			got[n] = string(m)
+		}
+
+		if strings.Join(got, "|") != strings.Join(c.messages, "|") {
+			t.Errorf("Unexpected messages of %q: %q", c.body, got)
+		}
+	}
+}
+
+// writeCert writes PEM encoded certificate signed by parent (self-signed if nil) and its key to dir
+func writeCert(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatalf("Can't generate key. Err: %s", err.Error())
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+
+	if err != nil {
+		t.Fatalf("Can't create certificate. Err: %s", err.Error())
+	}
+
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	cert, _ := x509.ParseCertificate(der)
+
+	return cert, key
+}
+
+func certTemplate(serial int64, cn string) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+}
+
+func TestHTTPSClientIdentity(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "logbay-https")
+
+	if err != nil {
+		t.Fatalf("Can't create temp dir. Err: %s", err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	caTemplate := certTemplate(1, "logbay-ca")
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign
+	ca, caKey := writeCert(t, dir, "ca", caTemplate, nil, nil)
+
+	server := certTemplate(2, "logbay")
+	server.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	writeCert(t, dir, "server", server, ca, caKey)
+	writeCert(t, dir, "app-1", certTemplate(3, "app-1"), ca, caKey)
+	writeCert(t, dir, "app-2", certTemplate(4, "app-2"), ca, caKey)
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	i, err := NewHTTPSIngest("https-identity", &httpsConf{
+		Bind:       "127.0.0.1",
+		Port:       port,
+		Cert:       filepath.Join(dir, "server.crt"),
+		Key:        filepath.Join(dir, "server.key"),
+		CA:         filepath.Join(dir, "ca.crt"),
+		ClientAuth: common.ClientAuthRequireAndVerify,
+		AllowedCN:  []string{"app-1"},
+	})
+
+	if err != nil {
+		t.Fatalf("Can't create ingest. Err: %s", err.Error())
+	}
+
+	if err := i.Start(); err != nil {
+		t.Fatalf("Can't start ingest. Err: %s", err.Error())
+	}
+
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		i.Stop(ctx)
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	post := func(client string) int {
+		cert, err := tls.LoadX509KeyPair(filepath.Join(dir, client+".crt"), filepath.Join(dir, client+".key"))
+
+		if err != nil {
+			t.Fatalf("Can't load client certificate. Err: %s", err.Error())
+		}
+
+		c := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}},
+		}}
+
+		resp, err := c.Post(fmt.Sprintf("https://127.0.0.1:%d/logbay", port), "text/plain", strings.NewReader("[INFO] started"))
+
+		if err != nil {
+			t.Fatalf("Can't post message. Err: %s", err.Error())
+		}
+
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	if status := post("app-2"); status != http.StatusForbidden {
+		t.Errorf("Expected client missing from allow-list to be rejected, got %d", status)
+	}
+
+	if status := post("app-1"); status != http.StatusAccepted {
+		t.Fatalf("Expected message to be accepted, got %d", status)
+	}
+
+	select {
+	case msg := <-i.Messages():
+		if msg.String() != "[INFO] started" || msg.Meta["tls_cn"] != "app-1" {
+			t.Errorf("Unexpected message %q with meta %v", msg, msg.Meta)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("No message received")
+	}
+}
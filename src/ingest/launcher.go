@@ -6,6 +6,7 @@ import (
 	"fmt"
 
 	"logbay/common"
+	"logbay/metrics"
 )
 
 var storage = make(map[string]common.Messenger)
@@ -20,28 +21,113 @@ func NewIngestPoint(i common.PointConfig) (point common.Messenger, err error) {
 		return nil, errors.New("already exists")
 	}
 
+	overflow := overflowConf{
+		Policy:     common.OverflowPolicy(i.Overflow),
+		SpillPath:  i.SpillPath,
+		SpillLimit: i.SpillLimit,
+	}
+
 	switch common.IngestType(i.Type) {
 	case common.IngestTLS:
 		point, err = NewTLSIngest(i.Name, &tlsConfig{
+			Bind:       i.Bind,
+			Port:       i.Port,
+			Cert:       i.Certificate,
+			Key:        i.Key,
+			CA:         i.CA,
+			ClientAuth: common.ClientAuth(i.ClientAuth),
+			AllowedCN:  i.AllowedCN,
+			AllowedSAN: i.AllowedSAN,
+			Delimiter:  i.Delimiter,
+			Framing:    common.Framing(i.Framing),
+			Multiline:  i.MultilinePattern,
+			Buffer:     i.Buffer,
+			Overflow:   overflow,
+		})
+	case common.IngestTCP:
+		point, err = NewTCPIngest(i.Name, &tcpConf{
+			Bind:      i.Bind,
 			Port:      i.Port,
-			Cert:      i.Certificate,
-			Key:       i.Key,
-			CA:        i.CA,
 			Delimiter: i.Delimiter,
+			Framing:   common.Framing(i.Framing),
+			Multiline: i.MultilinePattern,
 			Buffer:    i.Buffer,
+			Overflow:  overflow,
 		})
-	case common.IngestRedis:
-		point, err = NewRedisIngest(i.Name, &redisConf{
-			Host:    i.Host,
-			Port:    i.Port,
-			Channel: i.Pattern,
-			Buffer:  i.Buffer,
+	case common.IngestUDP:
+		point, err = NewUDPIngest(i.Name, &udpConf{
+			Bind:      i.Bind,
+			Port:      i.Port,
+			MaxSize:   i.MaxMessageSize,
+			Delimiter: i.Delimiter,
+			Buffer:    i.Buffer,
+			Overflow:  overflow,
 		})
+	case common.IngestSyslog:
+		point, err = NewSyslogIngest(i.Name, &syslogConf{
+			Transport: common.SyslogTransport(i.Transport),
+			Bind:      i.Bind,
+			Port:      i.Port,
+			MaxSize:   i.MaxMessageSize,
+			Delimiter: i.Delimiter,
+			TLS: common.ServerTLSConfig{
+				Cert:       i.Certificate,
+				Key:        i.Key,
+				CA:         i.CA,
+				ClientAuth: common.ClientAuth(i.ClientAuth),
+				AllowedCN:  i.AllowedCN,
+				AllowedSAN: i.AllowedSAN,
+			},
+			Buffer:   i.Buffer,
+			Overflow: overflow,
+		})
+	case common.IngestHTTPS:
+		point, err = NewHTTPSIngest(i.Name, &httpsConf{
+			Bind:       i.Bind,
+			Port:       i.Port,
+			Endpoint:   i.Endpoint,
+			Cert:       i.Certificate,
+			Key:        i.Key,
+			CA:         i.CA,
+			ClientAuth: common.ClientAuth(i.ClientAuth),
+			AllowedCN:  i.AllowedCN,
+			AllowedSAN: i.AllowedSAN,
+			Delimiter:  i.Delimiter,
+			Buffer:     i.Buffer,
+			Overflow:   overflow,
+		})
+	case common.IngestRedis:
+		switch common.RedisMode(i.Mode) {
+		case common.RedisStream:
+			point, err = NewRedisStreamIngest(i.Name, &redisStreamConf{
+				Host:        i.Host,
+				Port:        i.Port,
+				Stream:      i.Stream,
+				Group:       i.Group,
+				Consumer:    i.Consumer,
+				ReclaimIdle: i.ReclaimIdle.Duration,
+				Redis:       i.Redis,
+				Buffer:      i.Buffer,
+				Overflow:    overflow,
+			})
+		case "", common.RedisSubscribe:
+			point, err = NewRedisIngest(i.Name, &redisConf{
+				Host:     i.Host,
+				Port:     i.Port,
+				Channel:  i.Pattern,
+				Redis:    i.Redis,
+				Buffer:   i.Buffer,
+				Overflow: overflow,
+			})
+		default:
+			return nil, errors.New(fmt.Sprintf("invalid redis ingest mode %s", i.Mode))
+		}
 	case common.IngestSimulated:
 		point, err = NewSimulatedIngest(i.Name, &simulatorConf{
 			MsgLength: i.MsgLength,
 			MsgPerSec: i.MsgPerSec,
 			Buffer:    i.Buffer,
+			Overflow:  overflow,
 		})
 
 	default:
@@ -78,4 +164,9 @@ func SetIngestPoint(name string, i common.Messenger) {
 	}
 
 	storage[name] = i
+
+	metrics.RegisterIngestBuffer(name,
+		func() int { return len(i.Messages()) },
+		func() int { return cap(i.Messages()) },
+	)
 }
@@ -0,0 +1,432 @@
+package ingest
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"logbay/common"
+	"logbay/metrics"
+)
+
+const dropReportInterval = 10 * time.Second
+
+type overflowConf struct {
+	Policy     common.OverflowPolicy
+	SpillPath  string
+	SpillLimit int64
+}
+
+// outbox writes messages to ingest channel and decides what happens when channel buffer is full
+type outbox struct {
+	name       string
+	policy     common.OverflowPolicy
+	ch         chan *common.Message
+	spill      *spill
+	seq        uint64
+	dropped    uint64
+	reportedAt int64
+}
+
+func newOutbox(name string, ch chan *common.Message, conf *overflowConf) (*outbox, error) {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "outbox"))
+
+	o := &outbox{
+		name:   name,
+		policy: conf.Policy,
+		ch:     ch,
+	}
+
+	switch conf.Policy {
+	case "":
+		log.Debugf("OverflowPolicy is not configured for %s. Using %s", name, common.OverflowDropNewest)
+		o.policy = common.OverflowDropNewest
+	case common.OverflowBlock, common.OverflowDropNewest, common.OverflowDropOldest:
+	case common.OverflowSpill:
+		path := conf.SpillPath
+
+		if len(path) == 0 {
+			path = filepath.Join(os.TempDir(), fmt.Sprintf("logbay-%s.spill", name))
+			log.Debugf("SpillPath is not configured for %s. Using %s", name, path)
+		}
+
+		s, err := newSpill(path, conf.SpillLimit, ch)
+
+		if err != nil {
+			return nil, err
+		}
+
+		o.spill = s
+	default:
+		return nil, errors.New(fmt.Sprintf("invalid overflow policy %s", conf.Policy))
+	}
+
+	return o, nil
+}
+
+// write stamps message with ingest name and sequence number and puts it into ingest channel.
+// returns false if message is dropped
+func (o *outbox) write(msg *common.Message) bool {
+
+	metrics.IngestReceived.WithLabelValues(o.name).Inc()
+
+	msg.Ingest = o.name
+	msg.Seq = atomic.AddUint64(&o.seq, 1)
+
+	switch o.policy {
+	case common.OverflowBlock:
+		o.ch <- msg
+	case common.OverflowDropOldest:
+		for {
+			select {
+			case o.ch <- msg:
+				return true
+			default:
+			}
+
+			// make room by throwing away the oldest buffered message
+			select {
+			case oldest := <-o.ch:
+				o.drop(oldest)
+			default:
+			}
+		}
+	case common.OverflowSpill:
+		if !o.spill.write(msg) {
+			o.drop(msg)
+			return false
+		}
+	default:
+		select {
+		case o.ch <- msg:
+		default:
+			o.drop(msg)
+			return false
+		}
+	}
+
+	return true
+}
+
+// Dropped returns number of messages lost due to overflow
+func (o *outbox) Dropped() uint64 {
+	return atomic.LoadUint64(&o.dropped)
+}
+
+// close delivers spilled messages and closes ingest channel. must be called once all writers are done
+func (o *outbox) close(ctx context.Context) error {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "outbox"))
+
+	if o.spill != nil {
+		if err := o.spill.drain(ctx); err != nil {
+			return err
+		}
+	}
+
+	if dropped := o.Dropped(); dropped > 0 {
+		log.Warnf("%s dropped %d messages in total", o.name, dropped)
+	}
+
+	close(o.ch)
+	return nil
+}
+
+func (o *outbox) drop(msg *common.Message) {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "outbox"))
+
+	msg.Settle(false)
+	dropped := atomic.AddUint64(&o.dropped, 1)
+	metrics.IngestDropped.WithLabelValues(o.name).Inc()
+
+	// don't flood the log during bursts
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&o.reportedAt)
+
+	if now-last >= int64(dropReportInterval) && atomic.CompareAndSwapInt64(&o.reportedAt, last, now) {
+		log.Warnf("%s buffer is full. %d messages dropped so far", o.name, dropped)
+	}
+}
+
+// spill keeps messages which don't fit into channel in a file and feeds them back in order.
+// records left from previous run are delivered first
+type spill struct {
+	mu      sync.Mutex
+	path    string
+	limit   int64
+	size    int64
+	pending int64
+	ch      chan *common.Message
+	w       *os.File
+	r       *os.File
+	reader  *bufio.Reader
+	notify  chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newSpill(path string, limit int64, ch chan *common.Message) (*spill, error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	w, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := os.Open(path)
+
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	s := &spill{
+		path:   path,
+		limit:  limit,
+		ch:     ch,
+		w:      w,
+		r:      r,
+		reader: bufio.NewReader(r),
+		notify: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if err := s.recover(); err != nil {
+		w.Close()
+		r.Close()
+		return nil, err
+	}
+
+	go s.feed()
+
+	return s, nil
+}
+
+// recover counts complete records left in file by previous run
+func (s *spill) recover() error {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "outbox"))
+
+	reader := bufio.NewReader(s.r)
+
+	for {
+		n, err := skipRecord(reader)
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		s.pending++
+		s.size += n
+	}
+
+	// cut off partially written record, if any
+	if err := s.w.Truncate(s.size); err != nil {
+		return err
+	}
+
+	if _, err := s.r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if s.pending > 0 {
+		log.Infof("%d spilled messages found in %s", s.pending, s.path)
+		s.notify <- struct{}{}
+	}
+
+	return nil
+}
+
+// write sends message to channel if nothing is spilled yet. otherwise it goes to disk to keep the order
+func (s *spill) write(msg *common.Message) bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending == 0 {
+		select {
+		case s.ch <- msg:
+			return true
+		default:
+		}
+	}
+
+	body, err := json.Marshal(msg)
+
+	if err != nil {
+		return false
+	}
+
+	record := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(record, uint32(len(body)))
+	copy(record[4:], body)
+
+	if s.limit > 0 && s.size+int64(len(record)) > s.limit {
+		return false
+	}
+
+	if _, err := s.w.Write(record); err != nil {
+		return false
+	}
+
+	// spilled copy can't report back, so message is left to be redelivered by its source
+	msg.Settle(false)
+
+	s.size += int64(len(record))
+	s.pending++
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+func (s *spill) feed() {
+
+	defer close(s.done)
+
+	for {
+		stopping := false
+
+		select {
+		case <-s.notify:
+		case <-s.stop:
+			stopping = true
+		}
+
+		s.deliver()
+
+		if stopping {
+			return
+		}
+	}
+}
+
+func (s *spill) deliver() {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "outbox"))
+
+	for s.hasPending() {
+		msg, err := readRecord(s.reader)
+
+		if err != nil {
+			log.Errorf("Can't read spilled messages from %s. Err: %s", s.path, err.Error())
+			s.reset()
+			return
+		}
+
+		// record is counted as pending until it is delivered, so writers keep spilling meanwhile
+		s.ch <- msg
+
+		s.mu.Lock()
+		s.pending--
+		if s.pending == 0 {
+			s.truncate()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// drain waits for every spilled message to be delivered. must be called once all writers are done
+func (s *spill) drain(ctx context.Context) error {
+
+	close(s.stop)
+
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	s.w.Close()
+	s.r.Close()
+
+	return nil
+}
+
+func (s *spill) hasPending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending > 0
+}
+
+func (s *spill) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = 0
+	s.truncate()
+}
+
+// truncate empties spill file. must be called with lock held
+func (s *spill) truncate() {
+	s.w.Truncate(0)
+	s.r.Seek(0, io.SeekStart)
+	s.reader.Reset(s.r)
+	s.size = 0
+}
+
+func readRecord(r *bufio.Reader) (*common.Message, error) {
+
+	header := make([]byte, 4)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, binary.BigEndian.Uint32(header))
+
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	msg := &common.Message{}
+
+	if err := json.Unmarshal(body, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func skipRecord(r *bufio.Reader) (int64, error) {
+
+	header := make([]byte, 4)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+
+	length := int64(binary.BigEndian.Uint32(header))
+
+	if _, err := io.CopyN(ioutil.Discard, r, length); err != nil {
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+
+	return 4 + length, nil
+}
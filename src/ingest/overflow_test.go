@@ -0,0 +1,306 @@
+package ingest
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"logbay/common"
+)
+
+func newSpillOutbox(t *testing.T, path string, limit int64, ch chan *common.Message) *outbox {
+
+	out, err := newOutbox("spill-test", ch, &overflowConf{
+		Policy:     common.OverflowSpill,
+		SpillPath:  path,
+		SpillLimit: limit,
+	})
+
+	if err != nil {
+		t.Fatalf("Can't create outbox. Err: %s", err.Error())
+	}
+
+	return out
+}
+
+func spillDir(t *testing.T) string {
+
+	dir, err := ioutil.TempDir("", "logbay-spill")
+
+	if err != nil {
+		t.Fatalf("Can't create temp dir. Err: %s", err.Error())
+	}
+
+	return dir
+}
+
+// record frames message the way spill does
+func record(t *testing.T, msg *common.Message) []byte {
+
+	body, err := json.Marshal(msg)
+
+	if err != nil {
+		t.Fatalf("Can't marshal message. Err: %s", err.Error())
+	}
+
+	b := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(b, uint32(len(body)))
+	copy(b[4:], body)
+
+	return b
+}
+
+func fileSize(t *testing.T, path string) int64 {
+
+	info, err := os.Stat(path)
+
+	if err != nil {
+		t.Fatalf("Can't stat %s. Err: %s", path, err.Error())
+	}
+
+	return info.Size()
+}
+
+func closeOutbox(t *testing.T, out *outbox) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := out.close(ctx); err != nil {
+		t.Fatalf("Can't close outbox. Err: %s", err.Error())
+	}
+}
+
+func TestSpillRecordFraming(t *testing.T) {
+
+	dir := spillDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "framing.spill")
+
+	// unbuffered channel nobody reads from makes every message spill
+	ch := make(chan *common.Message)
+	out := newSpillOutbox(t, path, 0, ch)
+
+	settled := make(chan bool, 1)
+	msg := common.NewMessage([]byte("one"), "127.0.0.1")
+	msg.Meta = map[string]string{"tls_cn": "app-1"}
+	msg.OnSettle(func(ok bool) { settled <- ok })
+
+	if !out.write(msg) {
+		t.Fatal("Expected message to be spilled")
+	}
+
+	// spilled copy can't be acknowledged, so source is told to redeliver it
+	if ok := <-settled; ok {
+		t.Error("Expected spilled message to be settled as failed")
+	}
+
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		t.Fatalf("Can't read spill file. Err: %s", err.Error())
+	}
+
+	length := binary.BigEndian.Uint32(b)
+
+	if int(length) != len(b)-4 {
+		t.Fatalf("Expected single record of %d bytes, got file of %d", length, len(b))
+	}
+
+	spilled := &common.Message{}
+
+	if err := json.Unmarshal(b[4:], spilled); err != nil {
+		t.Fatalf("Can't decode record. Err: %s", err.Error())
+	}
+
+	if spilled.String() != "one" || spilled.Ingest != "spill-test" || spilled.Seq != 1 || spilled.Meta["tls_cn"] != "app-1" || !spilled.ReceivedAt.Equal(msg.ReceivedAt) {
+		t.Errorf("Unexpected spilled message %+v", spilled)
+	}
+
+	if got := <-ch; got.String() != "one" {
+		t.Errorf("Unexpected delivered message %s", got)
+	}
+
+	closeOutbox(t, out)
+}
+
+func TestSpillOrder(t *testing.T) {
+
+	dir := spillDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "order.spill")
+	ch := make(chan *common.Message, 2)
+	out := newSpillOutbox(t, path, 0, ch)
+
+	write := func(from, to int) {
+		for n := from; n <= to; n++ {
+			if !out.write(common.NewMessage([]byte(fmt.Sprintf("%d", n)), "")) {
+				t.Fatalf("Message %d is dropped", n)
+			}
+		}
+	}
+
+	expect := func(from, to int) {
+		for n := from; n <= to; n++ {
+			select {
+			case msg := <-ch:
+				if msg.String() != fmt.Sprintf("%d", n) {
+					t.Fatalf("Expected message %d, got %s", n, msg)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Message %d is not delivered", n)
+			}
+		}
+	}
+
+	// 1 and 2 fit into channel, the rest is spilled
+	write(1, 5)
+	expect(1, 1)
+
+	// live message goes after spilled ones even though channel has room
+	write(6, 6)
+	expect(2, 6)
+
+	// spill file is emptied once everything is delivered
+	deadline := time.Now().Add(5 * time.Second)
+
+	for fileSize(t, path) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if size := fileSize(t, path); size != 0 {
+		t.Errorf("Expected drained spill file to be truncated, got %d bytes", size)
+	}
+
+	write(7, 8)
+	expect(7, 8)
+
+	closeOutbox(t, out)
+
+	if _, ok := <-ch; ok {
+		t.Error("Expected channel to be closed")
+	}
+}
+
+func TestSpillLimit(t *testing.T) {
+
+	dir := spillDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "limit.spill")
+	ch := make(chan *common.Message)
+
+	first := common.NewMessage([]byte("one"), "")
+	first.Ingest, first.Seq = "spill-test", 1
+
+	// room for exactly one record
+	out := newSpillOutbox(t, path, int64(len(record(t, first))), ch)
+
+	settled := make(chan bool, 2)
+	messages := []*common.Message{common.NewMessage([]byte("one"), ""), common.NewMessage([]byte("two"), "")}
+
+	for _, msg := range messages {
+		msg.ReceivedAt = first.ReceivedAt
+		msg.OnSettle(func(ok bool) { settled <- ok })
+	}
+
+	if !out.write(messages[0]) {
+		t.Fatal("Expected message to be spilled")
+	}
+
+	if out.write(messages[1]) {
+		t.Fatal("Expected message over SpillLimit to be dropped")
+	}
+
+	if out.Dropped() != 1 {
+		t.Errorf("Expected 1 dropped message, got %d", out.Dropped())
+	}
+
+	if size := fileSize(t, path); size != int64(len(record(t, first))) {
+		t.Errorf("Expected dropped message not to be written, got %d bytes", size)
+	}
+
+	if ok := <-settled; ok {
+		t.Error("Expected spilled message to be settled as failed")
+	}
+
+	if ok := <-settled; ok {
+		t.Error("Expected dropped message to be settled as failed")
+	}
+
+	if msg := <-ch; msg.String() != "one" {
+		t.Errorf("Unexpected delivered message %s", msg)
+	}
+
+	closeOutbox(t, out)
+}
+
+func TestSpillRecoversAfterRestart(t *testing.T) {
+
+	dir := spillDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "restart.spill")
+
+	var leftover []byte
+
+	for _, payload := range []string{"one", "two"} {
+		leftover = append(leftover, record(t, common.NewMessage([]byte(payload), ""))...)
+	}
+
+	complete := int64(len(leftover))
+
+	// process was killed in the middle of writing third record
+	partial := record(t, common.NewMessage([]byte("three"), ""))
+	leftover = append(leftover, partial[:len(partial)/2]...)
+
+	if err := ioutil.WriteFile(path, leftover, 0600); err != nil {
+		t.Fatalf("Can't write spill file. Err: %s", err.Error())
+	}
+
+	ch := make(chan *common.Message)
+	out := newSpillOutbox(t, path, 0, ch)
+
+	// nothing is delivered until channel is read, so file holds recovered records only
+	if size := fileSize(t, path); size != complete {
+		t.Errorf("Expected partial record to be cut off, got %d bytes of %d", size, complete)
+	}
+
+	// message received after restart goes after leftover ones
+	if !out.write(common.NewMessage([]byte("four"), "")) {
+		t.Fatal("Expected message to be spilled")
+	}
+
+	for _, expected := range []string{"one", "two", "four"} {
+		select {
+		case msg := <-ch:
+			if msg.String() != expected {
+				t.Fatalf("Expected message %s, got %s", expected, msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Message %s is not delivered", expected)
+		}
+	}
+
+	closeOutbox(t, out)
+
+	if size := fileSize(t, path); size != 0 {
+		t.Errorf("Expected drained spill file to be truncated, got %d bytes", size)
+	}
+
+	// nothing is left for the next run
+	ch = make(chan *common.Message)
+	closeOutbox(t, newSpillOutbox(t, path, 0, ch))
+
+	if msg, ok := <-ch; ok {
+		t.Errorf("Unexpected message %s delivered after restart", msg)
+	}
+}
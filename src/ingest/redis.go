@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
-	"time"
 
 	"github.com/go-redis/redis"
 
@@ -13,15 +12,21 @@ import (
 )
 
 type redisConf struct {
-	Host    string
-	Port    int
-	Channel string
-	Buffer  int
+	Host     string
+	Port     int
+	Channel  string
+	Redis    common.RedisConfig
+	Buffer   int
+	Overflow overflowConf
 }
 
 type redisIngest struct {
 	common.IngestPoint
-	pub *redis.PubSub
+	out     *outbox
+	client  redis.UniversalClient
+	channel string
+	pub     *redis.PubSub
+	done    chan struct{}
 }
 
 func NewRedisIngest(name string, conf *redisConf) (common.Messenger, error) {
@@ -52,45 +57,78 @@ func NewRedisIngest(name string, conf *redisConf) (common.Messenger, error) {
 		conf.Buffer = 50
 	}
 
-	r := redis.NewClient(&redis.Options{
-		Addr: fmt.Sprintf("%s:%d", host, port),
-	})
+	r, err := common.NewRedisClient(host, port, conf.Redis)
+
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make(chan *common.Message, conf.Buffer)
+	out, err := newOutbox(name, msg, &conf.Overflow)
+
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
 
 	ingest := &redisIngest{
-		common.IngestPoint{
+		IngestPoint: common.IngestPoint{
 			Type: common.IngestRedis,
 			Name: name,
-			Msg:  make(chan string, conf.Buffer),
+			Msg:  msg,
 		},
-		r.PSubscribe(conf.Channel),
+		out:     out,
+		client:  r,
+		channel: conf.Channel,
+		done:    make(chan struct{}),
 	}
 
-	go ingest.read()
-
 	return ingest, nil
 }
 
-func (i *redisIngest) Messages() chan string {
-	return i.Msg
+func (i *redisIngest) Start() error {
+
+	i.pub = i.client.PSubscribe(i.channel)
+
+	go i.read()
+
+	return nil
 }
 
-func (i *redisIngest) read() {
-	for {
-		select {
-		case msg := <-i.pub.Channel():
-			i.write(msg.Payload)
-		default:
-			time.Sleep(100 * time.Millisecond)
-		}
+// Stop unsubscribes and waits for received messages to be written before closing messages channel
+func (i *redisIngest) Stop(ctx context.Context) error {
+
+	defer i.client.Close()
+
+	if i.pub == nil {
+		return i.out.close(ctx)
 	}
-}
 
-func (i *redisIngest) write(msg string) {
+	i.pub.Close()
 
 	select {
-	case i.Msg <- msg:
-	default:
-		// drop message if there are no consumers or if channel buffer is full. wait a little to reduce steal time
-		time.Sleep(100 * time.Millisecond)
+	case <-i.done:
+		return i.out.close(ctx)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (i *redisIngest) Messages() chan *common.Message {
+	return i.Msg
+}
+
+func (i *redisIngest) read() {
+
+	defer close(i.done)
+
+	// channel is closed once subscription is closed
+	for msg := range i.pub.Channel() {
+		m := common.NewMessage([]byte(msg.Payload), msg.Channel)
+		m.Meta = map[string]string{
+			"channel": msg.Channel,
+			"pattern": msg.Pattern,
+		}
+		i.out.write(m)
 	}
 }
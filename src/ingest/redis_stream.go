@@ -0,0 +1,423 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"logbay/common"
+)
+
+const (
+	streamReadCount = 100
+	streamBlock     = time.Second
+	streamRetry     = time.Second
+	streamAckBatch  = 100
+)
+
+type redisStreamConf struct {
+	Host        string
+	Port        int
+	Stream      string
+	Group       string
+	Consumer    string
+	ReclaimIdle time.Duration
+	Redis       common.RedisConfig
+	Buffer      int
+	Overflow    overflowConf
+}
+
+// redisStreamIngest reads stream entries as a member of consumer group. entry is acknowledged
+// once every digest accepted it, otherwise it stays pending and is reclaimed once it is idle for reclaimIdle
+type redisStreamIngest struct {
+	common.IngestPoint
+	out         *outbox
+	client      redis.UniversalClient
+	stream      string
+	group       string
+	consumer    string
+	reclaimIdle time.Duration
+	acks        chan string
+	inflight    sync.WaitGroup
+	mu          sync.Mutex
+	delivering  map[string]struct{}
+	stop        chan struct{}
+	done        chan struct{}
+	acked       chan struct{}
+	started     bool
+}
+
+func NewRedisStreamIngest(name string, conf *redisStreamConf) (common.Messenger, error) {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "redisIngest"))
+
+	var host, port = conf.Host, conf.Port
+
+	if len(name) == 0 {
+		name = fmt.Sprintf("redis-ingest#%d", rand.Int())
+	}
+
+	if len(conf.Stream) == 0 {
+		return nil, errors.New("stream can not be empty")
+	}
+
+	if len(conf.Host) == 0 {
+		log.Debugln("Host is not configured. Using localhost")
+		host = "localhost"
+	}
+
+	if conf.Port == 0 {
+		log.Debugln("Port is not configured. Using 6379")
+		port = 6379
+	}
+
+	if len(conf.Group) == 0 {
+		log.Debugln("Group is not configured. Using logbay")
+		conf.Group = "logbay"
+	}
+
+	if len(conf.Consumer) == 0 {
+		conf.Consumer, _ = os.Hostname()
+
+		if len(conf.Consumer) == 0 {
+			conf.Consumer = name
+		}
+
+		log.Debugf("Consumer is not configured. Using %s", conf.Consumer)
+	}
+
+	if conf.ReclaimIdle == 0 {
+		log.Debugln("ReclaimIdle is not configured. Using 1m")
+		conf.ReclaimIdle = time.Minute
+	}
+
+	if conf.Buffer == 0 {
+		conf.Buffer = 50
+	}
+
+	// unacknowledged entries are redelivered anyway, so waiting is better than dropping
+	if len(conf.Overflow.Policy) == 0 {
+		log.Debugf("OverflowPolicy is not configured for %s. Using %s", name, common.OverflowBlock)
+		conf.Overflow.Policy = common.OverflowBlock
+	}
+
+	// spilled entry would be delivered twice after restart, from spill file and as pending one
+	if conf.Overflow.Policy == common.OverflowSpill {
+		return nil, errors.New("spill overflow policy is not supported by stream ingest")
+	}
+
+	r, err := common.NewRedisClient(host, port, conf.Redis)
+
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make(chan *common.Message, conf.Buffer)
+	out, err := newOutbox(name, msg, &conf.Overflow)
+
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	ingest := &redisStreamIngest{
+		IngestPoint: common.IngestPoint{
+			Type: common.IngestRedis,
+			Name: name,
+			Msg:  msg,
+		},
+		out:         out,
+		client:      r,
+		stream:      conf.Stream,
+		group:       conf.Group,
+		consumer:    conf.Consumer,
+		reclaimIdle: conf.ReclaimIdle,
+		acks:        make(chan string, conf.Buffer),
+		delivering:  make(map[string]struct{}),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		acked:       make(chan struct{}),
+	}
+
+	return ingest, nil
+}
+
+func (i *redisStreamIngest) Start() error {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "redisIngest"))
+
+	err := i.client.XGroupCreateMkStream(i.stream, i.group, "$").Err()
+
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+
+	log.Infof("Reading stream %s as %s of group %s", i.stream, i.consumer, i.group)
+
+	i.started = true
+
+	go i.ack()
+	go i.read()
+
+	return nil
+}
+
+// Stop stops reading. delivered entries are acknowledged by Finish, digests may still hold them
+func (i *redisStreamIngest) Stop(ctx context.Context) error {
+
+	if !i.started {
+		return i.out.close(ctx)
+	}
+
+	close(i.stop)
+
+	select {
+	case <-i.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return i.out.close(ctx)
+}
+
+// Finish waits for delivered entries to be settled and acknowledges them before closing connection.
+// entries not settled before ctx is done stay pending and are reclaimed after restart
+func (i *redisStreamIngest) Finish(ctx context.Context) error {
+
+	defer i.client.Close()
+
+	if !i.started {
+		return nil
+	}
+
+	if err := common.WaitContext(ctx, &i.inflight); err != nil {
+		return err
+	}
+
+	close(i.acks)
+
+	select {
+	case <-i.acked:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (i *redisStreamIngest) Messages() chan *common.Message {
+	return i.Msg
+}
+
+func (i *redisStreamIngest) read() {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "redisIngest"))
+
+	defer close(i.done)
+
+	i.reclaim()
+	reclaimed := time.Now()
+
+	// entries delivered to this consumer before restart come first, then new ones
+	id := "0"
+
+	for {
+		select {
+		case <-i.stop:
+			return
+		default:
+		}
+
+		// entries which failed delivery stay pending, so they are picked up along with abandoned ones
+		if time.Since(reclaimed) >= i.reclaimIdle {
+			i.reclaim()
+			reclaimed = time.Now()
+		}
+
+		streams, err := i.client.XReadGroup(&redis.XReadGroupArgs{
+			Group:    i.group,
+			Consumer: i.consumer,
+			Streams:  []string{i.stream, id},
+			Count:    streamReadCount,
+			Block:    streamBlock,
+		}).Result()
+
+		if err == redis.Nil {
+			continue
+		}
+
+		if err != nil {
+			log.Errorf("Can't read stream %s. Err: %s", i.stream, err.Error())
+
+			select {
+			case <-i.stop:
+				return
+			case <-time.After(streamRetry):
+			}
+
+			continue
+		}
+
+		received := 0
+
+		for _, s := range streams {
+			for _, entry := range s.Messages {
+				i.write(entry)
+				received++
+
+				if id != ">" {
+					id = entry.ID
+				}
+			}
+		}
+
+		if received == 0 && id != ">" {
+			id = ">"
+		}
+	}
+}
+
+// reclaim takes over and delivers again entries nobody acknowledged for reclaimIdle. entries of other
+// consumers are left by them, entries of this one failed delivery. entries being delivered are skipped
+func (i *redisStreamIngest) reclaim() {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "redisIngest"))
+
+	start := "-"
+
+	for {
+		pending, err := i.client.XPendingExt(&redis.XPendingExtArgs{
+			Stream: i.stream,
+			Group:  i.group,
+			Start:  start,
+			End:    "+",
+			Count:  streamReadCount,
+		}).Result()
+
+		if err != nil {
+			log.Errorf("Can't list pending entries of %s. Err: %s", i.stream, err.Error())
+			return
+		}
+
+		ids := make([]string, 0, len(pending))
+
+		for _, p := range pending {
+			if p.Id != start && p.Idle >= i.reclaimIdle && !i.isDelivering(p.Id) {
+				ids = append(ids, p.Id)
+			}
+		}
+
+		if len(ids) > 0 {
+			claimed, err := i.client.XClaim(&redis.XClaimArgs{
+				Stream:   i.stream,
+				Group:    i.group,
+				Consumer: i.consumer,
+				MinIdle:  i.reclaimIdle,
+				Messages: ids,
+			}).Result()
+
+			if err != nil {
+				log.Errorf("Can't claim pending entries of %s. Err: %s", i.stream, err.Error())
+				return
+			}
+
+			log.Infof("Reclaimed %d pending entries of %s", len(claimed), i.stream)
+
+			for _, entry := range claimed {
+				i.write(entry)
+			}
+		}
+
+		if len(pending) < streamReadCount {
+			return
+		}
+
+		start = pending[len(pending)-1].Id
+	}
+}
+
+func (i *redisStreamIngest) write(entry redis.XMessage) {
+
+	// entry may be both reclaimed and read as pending one of this consumer
+	i.mu.Lock()
+	if _, ok := i.delivering[entry.ID]; ok {
+		i.mu.Unlock()
+		return
+	}
+	i.delivering[entry.ID] = struct{}{}
+	i.mu.Unlock()
+
+	var payload []byte
+
+	if v, ok := entry.Values["message"].(string); ok {
+		payload = []byte(v)
+	} else {
+		payload, _ = json.Marshal(entry.Values)
+	}
+
+	m := common.NewMessage(payload, i.stream)
+	m.Meta = map[string]string{
+		"stream": i.stream,
+		"id":     entry.ID,
+	}
+
+	id := entry.ID
+	i.inflight.Add(1)
+
+	m.OnSettle(func(ok bool) {
+		if ok {
+			i.acks <- id
+		}
+
+		i.mu.Lock()
+		delete(i.delivering, id)
+		i.mu.Unlock()
+
+		i.inflight.Done()
+	})
+
+	i.out.write(m)
+}
+
+func (i *redisStreamIngest) isDelivering(id string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	_, ok := i.delivering[id]
+	return ok
+}
+
+// ack acknowledges settled entries in batches
+func (i *redisStreamIngest) ack() {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "redisIngest"))
+
+	defer close(i.acked)
+
+	for id := range i.acks {
+		ids := []string{id}
+
+	batch:
+		for len(ids) < streamAckBatch {
+			select {
+			case id, ok := <-i.acks:
+				if !ok {
+					break batch
+				}
+				ids = append(ids, id)
+			default:
+				break batch
+			}
+		}
+
+		if err := i.client.XAck(i.stream, i.group, ids...).Err(); err != nil {
+			log.Errorf("Can't acknowledge %d entries of %s. Err: %s", len(ids), i.stream, err.Error())
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package ingest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"logbay/common"
+)
+
+type streamEntry struct {
+	id      string
+	message string
+}
+
+type pendingEntry struct {
+	consumer    string
+	deliveredAt time.Time
+}
+
+// fakeStream is a stand-in for redis server implementing commands of a single stream and consumer group
+type fakeStream struct {
+	mu        sync.Mutex
+	listener  net.Listener
+	entries   []streamEntry
+	delivered int
+	pending   map[string]*pendingEntry
+	acked     []string
+}
+
+func newFakeStream(t *testing.T, messages ...string) *fakeStream {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Can't listen. Err: %s", err.Error())
+	}
+
+	f := &fakeStream{
+		listener: listener,
+		pending:  make(map[string]*pendingEntry),
+	}
+
+	for n, m := range messages {
+		f.entries = append(f.entries, streamEntry{fmt.Sprintf("%d-0", n+1), m})
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go f.serve(conn)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeStream) port() int {
+	return f.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (f *fakeStream) serve(conn net.Conn) {
+
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	for {
+		args, err := readCommand(r)
+
+		if err != nil {
+			return
+		}
+
+		if _, err := io.WriteString(conn, f.execute(args)); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeStream) execute(args []string) string {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch strings.ToLower(args[0]) {
+	case "xgroup":
+		return "+OK\r\n"
+	case "xreadgroup":
+		// XREADGROUP GROUP group consumer COUNT n BLOCK ms STREAMS key id
+		consumer, id := args[3], args[len(args)-1]
+
+		if id != ">" {
+			return reply([]interface{}{[]interface{}{args[len(args)-2], f.pendingOf(consumer, id)}})
+		}
+
+		if f.delivered == len(f.entries) {
+			// emulate BLOCK without keeping the lock
+			f.mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			f.mu.Lock()
+			return "*-1\r\n"
+		}
+
+		var entries []interface{}
+
+		for ; f.delivered < len(f.entries); f.delivered++ {
+			e := f.entries[f.delivered]
+			f.pending[e.id] = &pendingEntry{consumer, time.Now()}
+			entries = append(entries, entry(e))
+		}
+
+		return reply([]interface{}{[]interface{}{args[len(args)-2], entries}})
+	case "xpending":
+		// XPENDING key group start end count
+		var result []interface{}
+
+		for _, id := range f.pendingIDs() {
+			p := f.pending[id]
+			idle := int64(time.Since(p.deliveredAt) / time.Millisecond)
+			result = append(result, []interface{}{id, p.consumer, idle, int64(1)})
+		}
+
+		return reply(result)
+	case "xclaim":
+		// XCLAIM key group consumer min-idle id...
+		minIdle, _ := strconv.Atoi(args[4])
+
+		var result []interface{}
+
+		for _, id := range args[5:] {
+			p, ok := f.pending[id]
+
+			if !ok || time.Since(p.deliveredAt) < time.Duration(minIdle)*time.Millisecond {
+				continue
+			}
+
+			p.consumer, p.deliveredAt = args[3], time.Now()
+			result = append(result, entry(f.find(id)))
+		}
+
+		return reply(result)
+	case "xack":
+		n := int64(0)
+
+		for _, id := range args[3:] {
+			if _, ok := f.pending[id]; ok {
+				delete(f.pending, id)
+				f.acked = append(f.acked, id)
+				n++
+			}
+		}
+
+		return reply(n)
+	}
+
+	return fmt.Sprintf("-ERR unknown command %s\r\n", args[0])
+}
+
+// pendingOf lists pending entries of consumer following id the way XREADGROUP does with explicit id
+func (f *fakeStream) pendingOf(consumer, after string) []interface{} {
+
+	var result []interface{}
+
+	for _, id := range f.pendingIDs() {
+		if f.pending[id].consumer == consumer && (after == "0" || id > after) {
+			f.pending[id].deliveredAt = time.Now()
+			result = append(result, entry(f.find(id)))
+		}
+	}
+
+	return result
+}
+
+func (f *fakeStream) pendingIDs() []string {
+
+	ids := make([]string, 0, len(f.pending))
+
+	for id := range f.pending {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+func (f *fakeStream) find(id string) streamEntry {
+
+	for _, e := range f.entries {
+		if e.id == id {
+			return e
+		}
+	}
+
+	return streamEntry{}
+}
+
+func (f *fakeStream) state() (acked []string, pending int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.acked...), len(f.pending)
+}
+
+func entry(e streamEntry) []interface{} {
+	return []interface{}{e.id, []interface{}{"message", e.message}}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+
+	line, err := r.ReadString('\n')
+
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+
+	for i := range args {
+		header, err := r.ReadString('\n')
+
+		if err != nil {
+			return nil, err
+		}
+
+		size, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+		buf := make([]byte, size+2)
+
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+
+		args[i] = string(buf[:size])
+	}
+
+	return args, nil
+}
+
+func reply(v interface{}) string {
+
+	switch v := v.(type) {
+	case string:
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case int64:
+		return fmt.Sprintf(":%d\r\n", v)
+	case []interface{}:
+		var b strings.Builder
+		fmt.Fprintf(&b, "*%d\r\n", len(v))
+		for _, item := range v {
+			b.WriteString(reply(item))
+		}
+		return b.String()
+	}
+
+	return "*-1\r\n"
+}
+
+func receive(t *testing.T, ch chan *common.Message) *common.Message {
+
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("No message received")
+	}
+
+	return nil
+}
+
+func TestRedisStreamAcknowledgesSettledEntries(t *testing.T) {
+
+	stream := newFakeStream(t, "one", "two")
+	defer stream.listener.Close()
+
+	i, err := NewRedisStreamIngest("stream-test", &redisStreamConf{
+		Host:        "127.0.0.1",
+		Port:        stream.port(),
+		Stream:      "logbay",
+		Consumer:    "test",
+		ReclaimIdle: 100 * time.Millisecond,
+	})
+
+	if err != nil {
+		t.Fatalf("Can't create ingest. Err: %s", err.Error())
+	}
+
+	if err := i.Start(); err != nil {
+		t.Fatalf("Can't start ingest. Err: %s", err.Error())
+	}
+
+	one, two := receive(t, i.Messages()), receive(t, i.Messages())
+
+	if one.String() != "one" || two.String() != "two" {
+		t.Fatalf("Unexpected messages %s, %s", one, two)
+	}
+
+	one.Settle(true)
+	two.Settle(false)
+
+	// entry which failed delivery is delivered again once it is idle for ReclaimIdle
+	again := receive(t, i.Messages())
+
+	if again.String() != "two" {
+		t.Fatalf("Expected failed entry to be delivered again, got %s", again)
+	}
+
+	again.Settle(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := i.Stop(ctx); err != nil {
+		t.Fatalf("Can't stop ingest. Err: %s", err.Error())
+	}
+
+	if err := i.(common.Acknowledger).Finish(ctx); err != nil {
+		t.Fatalf("Can't finish ingest. Err: %s", err.Error())
+	}
+
+	acked, pending := stream.state()
+
+	if strings.Join(acked, ",") != "1-0,2-0" || pending != 0 {
+		t.Errorf("Expected every entry to be acknowledged once, got %v and %d pending", acked, pending)
+	}
+}
+
+// holdingConsumer holds consumed messages until it is stopped, like digests batching messages do
+type holdingConsumer struct {
+	held []*common.Message
+}
+
+func (h *holdingConsumer) Start() error {
+	return nil
+}
+
+func (h *holdingConsumer) Stop(ctx context.Context) error {
+
+	for _, msg := range h.held {
+		msg.Release(true)
+	}
+
+	return nil
+}
+
+func (h *holdingConsumer) Consume(msg *common.Message) error {
+	msg.Hold(1)
+	h.held = append(h.held, msg)
+	return nil
+}
+
+func TestRedisStreamStopsWithoutWaitingForSettlement(t *testing.T) {
+
+	stream := newFakeStream(t, "one", "two")
+	defer stream.listener.Close()
+
+	i, err := NewRedisStreamIngest("stream-hold", &redisStreamConf{
+		Host:     "127.0.0.1",
+		Port:     stream.port(),
+		Stream:   "logbay",
+		Consumer: "test",
+	})
+
+	if err != nil {
+		t.Fatalf("Can't create ingest. Err: %s", err.Error())
+	}
+
+	if err := i.Start(); err != nil {
+		t.Fatalf("Can't start ingest. Err: %s", err.Error())
+	}
+
+	consumer := &holdingConsumer{}
+	consumer.Consume(receive(t, i.Messages()))
+	consumer.Consume(receive(t, i.Messages()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// shutdown order of main: ingests, then digests, then acknowledgements
+	stopCtx, stopCancel := context.WithTimeout(ctx, time.Second)
+	defer stopCancel()
+
+	if err := i.Stop(stopCtx); err != nil {
+		t.Fatalf("Ingest stop waited for held messages. Err: %s", err.Error())
+	}
+
+	if acked, _ := stream.state(); len(acked) != 0 {
+		t.Fatalf("Expected held entries not to be acknowledged, got %v", acked)
+	}
+
+	consumer.Stop(ctx)
+
+	if err := i.(common.Acknowledger).Finish(ctx); err != nil {
+		t.Fatalf("Can't finish ingest. Err: %s", err.Error())
+	}
+
+	if acked, pending := stream.state(); strings.Join(acked, ",") != "1-0,2-0" || pending != 0 {
+		t.Errorf("Expected entries settled on consumer stop to be acknowledged, got %v and %d pending", acked, pending)
+	}
+}
+
+func TestRedisStreamRejectsSpill(t *testing.T) {
+
+	_, err := NewRedisStreamIngest("stream-spill", &redisStreamConf{
+		Stream:   "logbay",
+		Overflow: overflowConf{Policy: common.OverflowSpill},
+	})
+
+	if err == nil {
+		t.Error("Expected spill overflow policy to be rejected")
+	}
+}
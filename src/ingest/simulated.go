@@ -13,12 +13,17 @@ type simulatorConf struct {
 	MsgLength int
 	MsgPerSec int
 	Buffer    int
+	Overflow  overflowConf
 }
 
 type simulatedIngest struct {
 	msgLength  int
 	throughput int
-	msg        chan string
+	msg        chan *common.Message
+	out        *outbox
+	stop       chan struct{}
+	done       chan struct{}
+	started    bool
 }
 
 const charset = "abcdefghijklmnopqrstuvwxyz" +
@@ -49,18 +54,48 @@ func NewSimulatedIngest(name string, conf *simulatorConf) (common.Messenger, err
 		conf.Buffer = 50
 	}
 
+	msg := make(chan *common.Message, conf.Buffer)
+	out, err := newOutbox(name, msg, &conf.Overflow)
+
+	if err != nil {
+		return nil, err
+	}
+
 	s := &simulatedIngest{
 		msgLength:  conf.MsgLength,
 		throughput: conf.MsgPerSec,
-		msg:        make(chan string, conf.Buffer),
+		msg:        msg,
+		out:        out,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
 	}
 
-	go s.start()
-
 	return s, nil
 }
 
-func (i *simulatedIngest) Messages() chan string {
+func (i *simulatedIngest) Start() error {
+	i.started = true
+	go i.start()
+	return nil
+}
+
+func (i *simulatedIngest) Stop(ctx context.Context) error {
+
+	if !i.started {
+		return i.out.close(ctx)
+	}
+
+	close(i.stop)
+
+	select {
+	case <-i.done:
+		return i.out.close(ctx)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (i *simulatedIngest) Messages() chan *common.Message {
 	return i.msg
 }
 
@@ -71,8 +106,16 @@ func (i *simulatedIngest) start() {
 
 	timer := time.NewTicker(time.Duration(intervalMs+randomDelay) * time.Microsecond)
 
-	for range timer.C {
-		i.msg <- String(i.msgLength)
+	defer close(i.done)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			i.out.write(common.NewMessage([]byte(String(i.msgLength)), ""))
+		case <-i.stop:
+			return
+		}
 	}
 }
 
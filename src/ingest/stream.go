@@ -0,0 +1,218 @@
+package ingest
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"logbay/common"
+)
+
+const readTimeout = 30 * time.Second
+
+// streamIngest accepts connections and reads messages from them with framer made by framing. connections are
+// TLS ones if config is set and plain TCP otherwise. decode, if set, turns frame into message payload
+type streamIngest struct {
+	common.IngestPoint
+	out         *outbox
+	prefix      string
+	addr        string
+	config      *tls.Config
+	certs       *common.CertReloader
+	allowed     *common.AllowList
+	framing     func() framer
+	decode      func([]byte) []byte
+	connections *prometheus.GaugeVec
+	listener    net.Listener
+	stopping    int32
+	mu          sync.Mutex
+	conns       map[net.Conn]struct{}
+	wg          sync.WaitGroup
+}
+
+func (i *streamIngest) Start() error {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", i.prefix))
+
+	var server net.Listener
+	var err error
+
+	if i.config != nil {
+		server, err = tls.Listen("tcp", i.addr, i.config)
+	} else {
+		server, err = net.Listen("tcp", i.addr)
+	}
+
+	if err != nil {
+		log.Errorf("Failed to start server. Err: %s", err.Error())
+		return err
+	}
+
+	i.listener = server
+
+	log.Infof("Listening for incoming %s connections on %s", i.Type, i.addr)
+
+	if i.certs != nil {
+		go i.certs.Watch()
+	}
+
+	i.wg.Add(1)
+	go i.accept()
+
+	return nil
+}
+
+// Stop closes listener and makes connection readers return after messages read so far are written
+func (i *streamIngest) Stop(ctx context.Context) error {
+
+	atomic.StoreInt32(&i.stopping, 1)
+
+	if i.listener != nil {
+		i.listener.Close()
+
+		if i.certs != nil {
+			i.certs.Close()
+		}
+	}
+
+	i.mu.Lock()
+	for conn := range i.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	i.mu.Unlock()
+
+	if err := common.WaitContext(ctx, &i.wg); err != nil {
+		return err
+	}
+
+	return i.out.close(ctx)
+}
+
+func (i *streamIngest) accept() {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", i.prefix))
+
+	defer i.wg.Done()
+
+	for {
+		conn, err := i.listener.Accept()
+
+		if err != nil {
+			if atomic.LoadInt32(&i.stopping) == 1 {
+				return
+			}
+
+			log.Errorf("Can't accept incoming connection. Err: %s", err.Error())
+			continue
+		}
+
+		log.Debugf("Accepted connection from %s", conn.RemoteAddr())
+
+		i.mu.Lock()
+		if atomic.LoadInt32(&i.stopping) == 1 {
+			i.mu.Unlock()
+			conn.Close()
+			return
+		}
+		i.conns[conn] = struct{}{}
+		i.mu.Unlock()
+
+		connections := i.connections.WithLabelValues(i.Name)
+		connections.Inc()
+
+		i.wg.Add(1)
+		go func(conn net.Conn) {
+			defer i.wg.Done()
+			defer connections.Dec()
+
+			i.read(conn)
+
+			i.mu.Lock()
+			delete(i.conns, conn)
+			i.mu.Unlock()
+		}(conn)
+	}
+}
+
+func (i *streamIngest) read(conn net.Conn) {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", i.prefix))
+
+	defer conn.Close()
+
+	var identity map[string]string
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		var err error
+
+		identity, err = i.handshake(tlsConn)
+
+		if err != nil && atomic.LoadInt32(&i.stopping) == 1 {
+			log.Debugf("Closing connection %s on shutdown", conn.RemoteAddr())
+			return
+		}
+
+		if err != nil {
+			log.Warnf("Rejected connection from %s. Err: %s", conn.RemoteAddr(), err.Error())
+			return
+		}
+	}
+
+	r := newFrameReader(&connReader{i: i, conn: conn})
+	frame := i.framing()
+
+	for {
+		b, err := frame(r)
+
+		if err == nil {
+			i.write(b, conn, identity)
+			continue
+		}
+
+		switch {
+		case err == io.EOF:
+			log.Debugf("Connection %s closed by other party", conn.RemoteAddr())
+		case atomic.LoadInt32(&i.stopping) == 1:
+			log.Debugf("Closing connection %s on shutdown", conn.RemoteAddr())
+		default:
+			log.Debugf("Unexpected error while reading from %s. Closing connection now. Err: %s", conn.RemoteAddr(), err.Error())
+			return
+		}
+
+		// last message may come without delimiter
+		i.write(b, conn, identity)
+		return
+	}
+}
+
+func (i *streamIngest) write(b []byte, conn net.Conn, identity map[string]string) {
+
+	if len(b) == 0 {
+		return
+	}
+
+	if i.decode != nil {
+		b = i.decode(b)
+	}
+
+	m := common.NewMessage(b, conn.RemoteAddr().String())
+
+	if len(identity) > 0 {
+		m.Meta = make(map[string]string, len(identity))
+		for k, v := range identity {
+			m.Meta[k] = v
+		}
+	}
+
+	i.out.write(m)
+}
+
+func (i *streamIngest) Messages() chan *common.Message {
+	return i.Msg
+}
@@ -0,0 +1,375 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	random "math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"logbay/common"
+	"logbay/metrics"
+)
+
+const nilValue = "-"
+
+type syslogConf struct {
+	Transport common.SyslogTransport
+	Bind      string
+	Port      int
+	MaxSize   int
+	Delimiter byte
+	TLS       common.ServerTLSConfig
+	Buffer    int
+	Overflow  overflowConf
+}
+
+// NewSyslogIngest creates ingest receiving syslog messages over UDP, TCP or TLS. stream transports
+// accept both octet-counted and delimited messages (RFC 6587)
+func NewSyslogIngest(name string, conf *syslogConf) (common.Messenger, error) {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "syslogIngest"))
+
+	if len(name) == 0 {
+		name = fmt.Sprintf("syslog-ingest#%d", random.Int())
+	}
+
+	if len(conf.Transport) == 0 {
+		log.Debugf("Transport is not configured. Using %s", common.SyslogUDP)
+		conf.Transport = common.SyslogUDP
+	}
+
+	if conf.Port == 0 {
+		conf.Port = 514
+
+		if conf.Transport == common.SyslogTLS {
+			conf.Port = 6514
+		}
+
+		log.Debugf("Port is not configured. Using %d", conf.Port)
+	}
+
+	if conf.Delimiter == 0 {
+		conf.Delimiter = '\n'
+	}
+
+	if len(conf.Bind) == 0 {
+		conf.Bind = "0.0.0.0"
+	}
+
+	if conf.Buffer == 0 {
+		conf.Buffer = 50
+	}
+
+	if conf.MaxSize == 0 {
+		conf.MaxSize = defaultDatagramSize
+	}
+
+	msg := make(chan *common.Message, conf.Buffer)
+	point := common.IngestPoint{
+		Name: name,
+		Type: common.IngestSyslog,
+		Msg:  msg,
+	}
+	addr := net.JoinHostPort(conf.Bind, strconv.Itoa(conf.Port))
+
+	switch conf.Transport {
+	case common.SyslogUDP:
+		out, err := newOutbox(name, msg, &conf.Overflow)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &udpIngest{
+			IngestPoint: point,
+			out:         out,
+			addr:        addr,
+			maxSize:     conf.MaxSize,
+			delimiter:   conf.Delimiter,
+			decode:      decodeSyslog,
+			done:        make(chan struct{}),
+		}, nil
+	case common.SyslogTCP, common.SyslogTLS:
+		ingest := &streamIngest{
+			IngestPoint: point,
+			prefix:      "syslogIngest",
+			addr:        addr,
+			framing:     func() framer { return syslogFraming(conf.Delimiter, conf.MaxSize) },
+			decode:      decodeSyslog,
+			connections: metrics.TCPConnections,
+			conns:       make(map[net.Conn]struct{}),
+		}
+
+		if conf.Transport == common.SyslogTLS {
+			config, certs, err := common.ServerTLS(&conf.TLS)
+
+			if err != nil {
+				return nil, err
+			}
+
+			ingest.config = config
+			ingest.certs = certs
+			ingest.allowed = common.NewAllowList(conf.TLS.AllowedCN, conf.TLS.AllowedSAN)
+			ingest.connections = metrics.TLSConnections
+		}
+
+		out, err := newOutbox(name, msg, &conf.Overflow)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ingest.out = out
+
+		return ingest, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("invalid syslog transport %s", conf.Transport))
+}
+
+// syslogEntry is JSON payload of message parsed from RFC 5424 or RFC 3164 syslog line
+type syslogEntry struct {
+	Facility       int                          `json:"facility"`
+	Severity       int                          `json:"severity"`
+	Timestamp      string                       `json:"timestamp,omitempty"`
+	Hostname       string                       `json:"hostname,omitempty"`
+	AppName        string                       `json:"app_name,omitempty"`
+	ProcID         string                       `json:"proc_id,omitempty"`
+	MsgID          string                       `json:"msg_id,omitempty"`
+	StructuredData map[string]map[string]string `json:"structured_data,omitempty"`
+	Message        string                       `json:"message"`
+}
+
+// decodeSyslog turns syslog line into JSON. lines which aren't syslog are passed as message field
+func decodeSyslog(line []byte) []byte {
+
+	line = bytes.TrimRight(line, "\r\n\x00")
+
+	entry, err := parseSyslog(string(line), time.Now())
+
+	if err != nil {
+		entry = &syslogEntry{Facility: 1, Severity: 5, Message: string(line)}
+	}
+
+	b, _ := json.Marshal(entry)
+	return b
+}
+
+func parseSyslog(line string, now time.Time) (*syslogEntry, error) {
+
+	if !strings.HasPrefix(line, "<") {
+		return nil, errors.New("missing priority")
+	}
+
+	end := strings.IndexByte(line, '>')
+
+	if end < 2 || end > 4 {
+		return nil, errors.New("invalid priority")
+	}
+
+	pri, err := strconv.Atoi(line[1:end])
+
+	if err != nil || pri > 191 {
+		return nil, errors.New("invalid priority")
+	}
+
+	entry := &syslogEntry{Facility: pri / 8, Severity: pri % 8}
+	rest := line[end+1:]
+
+	// RFC 5424 header continues with version
+	if strings.HasPrefix(rest, "1 ") {
+		return entry, parseRFC5424(entry, rest[2:])
+	}
+
+	parseRFC3164(entry, rest, now)
+
+	return entry, nil
+}
+
+// parseRFC5424 parses TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func parseRFC5424(entry *syslogEntry, rest string) error {
+
+	fields := make([]string, 5)
+
+	for n := range fields {
+		var ok bool
+
+		if fields[n], rest, ok = token(rest); !ok {
+			return errors.New("truncated header")
+		}
+
+		if fields[n] == nilValue {
+			fields[n] = ""
+		}
+	}
+
+	entry.Timestamp = fields[0]
+	entry.Hostname = fields[1]
+	entry.AppName = fields[2]
+	entry.ProcID = fields[3]
+	entry.MsgID = fields[4]
+
+	if strings.HasPrefix(rest, nilValue) {
+		rest = rest[1:]
+	} else {
+		sd, tail, err := parseStructuredData(rest)
+
+		if err != nil {
+			return err
+		}
+
+		entry.StructuredData = sd
+		rest = tail
+	}
+
+	rest = strings.TrimPrefix(rest, " ")
+	entry.Message = strings.TrimPrefix(rest, "\ufeff")
+
+	return nil
+}
+
+// parseStructuredData parses [id name="value" ...] elements. \", \\ and \] are unescaped in values
+func parseStructuredData(s string) (map[string]map[string]string, string, error) {
+
+	sd := make(map[string]map[string]string)
+
+	for strings.HasPrefix(s, "[") {
+		s = s[1:]
+
+		end := strings.IndexAny(s, " ]")
+
+		if end < 0 {
+			return nil, s, errors.New("unterminated structured data")
+		}
+
+		params := make(map[string]string)
+		sd[s[:end]] = params
+		s = s[end:]
+
+		for {
+			s = strings.TrimLeft(s, " ")
+
+			if strings.HasPrefix(s, "]") {
+				s = s[1:]
+				break
+			}
+
+			eq := strings.Index(s, "=\"")
+
+			if eq < 0 {
+				return nil, s, errors.New("invalid structured data parameter")
+			}
+
+			name := s[:eq]
+			s = s[eq+2:]
+
+			var value strings.Builder
+			closed := false
+
+			for len(s) > 0 && !closed {
+				switch {
+				case s[0] == '\\' && len(s) > 1 && strings.IndexByte(`"\]`, s[1]) >= 0:
+					value.WriteByte(s[1])
+					s = s[2:]
+				case s[0] == '"':
+					closed = true
+					s = s[1:]
+				default:
+					value.WriteByte(s[0])
+					s = s[1:]
+				}
+			}
+
+			if !closed {
+				return nil, s, errors.New("unterminated structured data value")
+			}
+
+			params[name] = value.String()
+		}
+	}
+
+	return sd, s, nil
+}
+
+// parseRFC3164 parses loosely formatted "Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG". parts which
+// don't match are left in message
+func parseRFC3164(entry *syslogEntry, rest string, now time.Time) {
+
+	entry.Message = rest
+
+	if len(rest) < len(time.Stamp)+1 {
+		return
+	}
+
+	stamp, err := time.Parse(time.Stamp, rest[:len(time.Stamp)])
+
+	if err != nil {
+		return
+	}
+
+	// timestamp has no year. message from December received in January belongs to the previous year
+	year := now.Year()
+
+	if date(year, stamp, now.Location()).After(now.AddDate(0, 0, 1)) {
+		year--
+	}
+
+	ts := date(year, stamp, now.Location())
+
+	// Feb 29 of non-leap year
+	if ts.Day() != stamp.Day() {
+		return
+	}
+
+	entry.Timestamp = ts.Format(time.RFC3339)
+	rest = strings.TrimPrefix(rest[len(time.Stamp):], " ")
+
+	if host, tail, ok := token(rest); ok && !strings.HasSuffix(host, ":") {
+		entry.Hostname = host
+		rest = tail
+	}
+
+	// TAG is alphanumeric app name optionally followed by [PID], terminated by colon
+	tagEnd := strings.IndexAny(rest, ":[ ")
+
+	if tagEnd <= 0 || tagEnd > 48 || rest[tagEnd] == ' ' {
+		entry.Message = rest
+		return
+	}
+
+	entry.AppName = rest[:tagEnd]
+	rest = rest[tagEnd:]
+
+	if strings.HasPrefix(rest, "[") {
+		if end := strings.IndexByte(rest, ']'); end > 0 {
+			entry.ProcID = rest[1:end]
+			rest = rest[end+1:]
+		}
+	}
+
+	rest = strings.TrimPrefix(rest, ":")
+	entry.Message = strings.TrimPrefix(rest, " ")
+}
+
+// date places month, day and clock of stamp into year
+func date(year int, stamp time.Time, loc *time.Location) time.Time {
+	return time.Date(year, stamp.Month(), stamp.Day(), stamp.Hour(), stamp.Minute(), stamp.Second(), 0, loc)
+}
+
+// token returns space-terminated token and the rest of s after that space
+func token(s string) (string, string, bool) {
+
+	end := strings.IndexByte(s, ' ')
+
+	if end <= 0 {
+		return "", s, false
+	}
+
+	return s[:end], s[end+1:], true
+}
@@ -0,0 +1,87 @@
+package ingest
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRFC3164Timestamp(t *testing.T) {
+
+	cases := []struct {
+		now       string
+		stamp     string
+		timestamp string
+	}{
+		{"2026-10-17T12:00:00Z", "Oct 17 11:59:00", "2026-10-17T11:59:00Z"},
+		// clock skew up to a day is tolerated
+		{"2026-10-17T12:00:00Z", "Oct 18 01:00:00", "2026-10-18T01:00:00Z"},
+		// message from December received in January belongs to the previous year
+		{"2027-01-01T00:00:10Z", "Dec 31 23:59:59", "2026-12-31T23:59:59Z"},
+		{"2028-03-01T00:00:00Z", "Feb 29 23:00:00", "2028-02-29T23:00:00Z"},
+		// there was no Feb 29 in 2026, so timestamp is left in message
+		{"2026-03-01T00:00:00Z", "Feb 29 23:00:00", ""},
+	}
+
+	for _, c := range cases {
+		now, _ := time.Parse(time.RFC3339, c.now)
+
+		entry, err := parseSyslog("<13>"+c.stamp+" host app: hello", now)
+
+		if err != nil {
+			t.Fatalf("Can't parse %s. Err: %s", c.stamp, err.Error())
+		}
+
+		if entry.Timestamp != c.timestamp {
+			t.Errorf("%s received at %s. Expected %q, got %q", c.stamp, c.now, c.timestamp, entry.Timestamp)
+		}
+	}
+}
+
+func TestSyslogFramingLimit(t *testing.T) {
+
+	cases := []struct {
+		input string
+		limit int
+		fails bool
+	}{
+		{"<13>abcd\n", 8, false},
+		{"<13>abcde\n", 8, true},
+		{"8 <13>abcd", 8, false},
+		{"9 <13>abcde", 8, true},
+		// lines longer than read buffer
+		{"<13>" + strings.Repeat("a", 36) + "\n", 40, false},
+		{"<13>" + strings.Repeat("a", 37) + "\n", 40, true},
+	}
+
+	for _, c := range cases {
+		frame := syslogFraming('\n', c.limit)
+		b, err := frame(&frameReader{Reader: bufio.NewReaderSize(strings.NewReader(c.input), 16)})
+
+		if c.fails != (err != nil) {
+			t.Errorf("Unexpected result for %q: %q, %v", c.input, b, err)
+		}
+	}
+	// length header of digits which never ends with space
+	digits := &countingReader{Reader: strings.NewReader(strings.Repeat("1", 1<<20))}
+	frame := syslogFraming('\n', 8192)
+	_, err := frame(&frameReader{Reader: bufio.NewReaderSize(digits, 16)})
+
+	if err == nil || digits.n > 64 {
+		t.Errorf("Expected long length header to fail the frame, read %d bytes: %v", digits.n, err)
+	}
+}
+
+// countingReader counts bytes read from Reader
+type countingReader struct {
+	io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += n
+	return n, err
+}
@@ -0,0 +1,80 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	random "math/rand"
+	"net"
+	"strconv"
+
+	"logbay/common"
+	"logbay/metrics"
+)
+
+type tcpConf struct {
+	Bind      string
+	Port      int
+	Delimiter byte
+	Framing   common.Framing
+	Multiline string
+	Buffer    int
+	Overflow  overflowConf
+}
+
+func NewTCPIngest(name string, conf *tcpConf) (common.Messenger, error) {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "tcpIngest"))
+
+	if conf.Port == 0 {
+		log.Warnf("TCP port should be > 0")
+		return nil, errors.New("invalid port 0")
+	}
+
+	if conf.Delimiter == 0 {
+		log.Infof("Delimiter is not configured. Using '\\n'")
+		conf.Delimiter = '\n'
+	}
+
+	if len(conf.Bind) == 0 {
+		conf.Bind = "0.0.0.0"
+	}
+
+	if len(name) == 0 {
+		name = fmt.Sprintf("tcp-ingest#%d", random.Int())
+	}
+
+	if conf.Buffer == 0 {
+		conf.Buffer = 50
+	}
+
+	framing, err := newFraming(conf.Framing, conf.Delimiter, conf.Multiline)
+
+	if err != nil {
+		log.Warnf("Can't configure framing. Err: %s", err.Error())
+		return nil, err
+	}
+
+	msg := make(chan *common.Message, conf.Buffer)
+	out, err := newOutbox(name, msg, &conf.Overflow)
+
+	if err != nil {
+		return nil, err
+	}
+
+	point := &streamIngest{
+		IngestPoint: common.IngestPoint{
+			Name: name,
+			Type: common.IngestTCP,
+			Msg:  msg,
+		},
+		out:         out,
+		prefix:      "tcpIngest",
+		addr:        net.JoinHostPort(conf.Bind, strconv.Itoa(conf.Port)),
+		framing:     framing,
+		connections: metrics.TCPConnections,
+		conns:       make(map[net.Conn]struct{}),
+	}
+
+	return point, nil
+}
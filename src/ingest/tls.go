@@ -1,34 +1,34 @@
 package ingest
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"crypto/rand"
-	"crypto/tls"
-	"encoding/pem"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	random "math/rand"
 	"net"
+	"strconv"
 	"time"
 
 	"logbay/common"
+	"logbay/metrics"
 )
 
-type tlsConfig struct {
-	Port      int
-	Cert      string
-	Key       string
-	CA        string
-	Delimiter byte
-	Buffer    int
-}
+const handshakeTimeout = 10 * time.Second
 
-type tlsIngest struct {
-	common.IngestPoint
+type tlsConfig struct {
+	Bind       string
+	Port       int
+	Cert       string
+	Key        string
+	CA         string
+	ClientAuth common.ClientAuth
+	AllowedCN  []string
+	AllowedSAN []string
+	Delimiter  byte
+	Framing    common.Framing
+	Multiline  string
+	Buffer     int
+	Overflow   overflowConf
 }
 
 func NewTLSIngest(name string, conf *tlsConfig) (common.Messenger, error) {
@@ -40,16 +40,15 @@ func NewTLSIngest(name string, conf *tlsConfig) (common.Messenger, error) {
 		return nil, errors.New("invalid port 0")
 	}
 
-	if len(conf.Cert) == 0 || len(conf.Key) == 0 {
-		log.Warnf("Invalid certificate or key path. Cert: %s. Key: %s", conf.Cert, conf.Key)
-		return nil, errors.New("invalid certificate or key path")
-	}
-
 	if conf.Delimiter == 0 {
 		log.Infof("Delimiter is not configured. Using '\\n'")
 		conf.Delimiter = '\n'
 	}
 
+	if len(conf.Bind) == 0 {
+		conf.Bind = "0.0.0.0"
+	}
+
 	if len(name) == 0 {
 		name = fmt.Sprintf("tls-ingest#%d", random.Int())
 	}
@@ -58,124 +57,49 @@ func NewTLSIngest(name string, conf *tlsConfig) (common.Messenger, error) {
 		conf.Buffer = 50
 	}
 
-	point := &tlsIngest{
-		common.IngestPoint{
-			Name: name,
-			Type: common.IngestTLS,
-			Msg:  make(chan string, conf.Buffer),
-		},
-	}
-
-	cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+	tlsConfig, certs, err := common.ServerTLS(&common.ServerTLSConfig{
+		Cert:       conf.Cert,
+		Key:        conf.Key,
+		CA:         conf.CA,
+		ClientAuth: conf.ClientAuth,
+		AllowedCN:  conf.AllowedCN,
+		AllowedSAN: conf.AllowedSAN,
+	})
 
 	if err != nil {
-		log.Errorf("Failed to load keypair. Err: %s", err.Error())
 		return nil, err
 	}
 
-	ca, err := ioutil.ReadFile(conf.CA)
+	framing, err := newFraming(conf.Framing, conf.Delimiter, conf.Multiline)
 
 	if err != nil {
-		log.Errorf("failed to read certificate authority chain. Err: %s", err.Error())
+		log.Warnf("Can't configure framing. Err: %s", err.Error())
 		return nil, err
 	}
 
-	{
-		var der *pem.Block
-		rest := []byte(ca)
-
-		duplicate := func(b []byte) bool {
-			for _, data := range cert.Certificate {
-				if bytes.Equal(data, b) {
-					return true
-				}
-			}
-			return false
-		}
-
-		for {
-			der, rest = pem.Decode(rest)
-			if der == nil {
-				break
-			}
-			if der.Type != "CERTIFICATE" {
-				continue
-			}
-			if duplicate(der.Bytes) {
-				continue
-			}
-			cert.Certificate = append(cert.Certificate, der.Bytes)
-		}
-	}
-
-	tlsConfig := tls.Config{Certificates: []tls.Certificate{cert}}
-	tlsConfig.Rand = rand.Reader
-
-	server, err := tls.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", conf.Port), &tlsConfig)
+	msg := make(chan *common.Message, conf.Buffer)
+	out, err := newOutbox(name, msg, &conf.Overflow)
 
 	if err != nil {
-		log.Errorf("Failed to start server. Err: %s", err.Error())
 		return nil, err
 	}
 
-	log.Infof("Listening for incoming TLS connections on %d", conf.Port)
-
-	go func(server net.Listener, ch chan string) {
-		for {
-			conn, err := server.Accept()
-
-			if err != nil {
-				log.Errorf("Can't accept incoming connection. Err: %s", err.Error())
-				continue
-			}
-
-			log.Debugf("Accepted connection from %s", conn.RemoteAddr())
-
-			go read(conn, ch, conf.Delimiter)
-		}
-	}(server, point.Msg)
-
-	return point, nil
-}
-
-func read(conn net.Conn, ch chan string, delim byte) {
-
-	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "tlsIngest"))
-
-	defer conn.Close()
-	r := bufio.NewReader(conn)
-
-	for {
-		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
-		b, err := r.ReadBytes(delim)
-
-		if err != nil {
-
-			if err == io.EOF {
-				log.Debugf("Connection %s closed by other party", conn.RemoteAddr())
-				break
-			}
-
-			if netErr, ok := err.(net.Error); ok && !netErr.Temporary() {
-				// unexpected error
-				log.Debugf("Unexpected error while reading from %s. Closing connection now", conn.RemoteAddr())
-				break
-			}
-		}
-
-		if len(b) == 0 {
-			continue
-		}
-
-		select {
-		case ch <- string(b[:len(b)-1]):
-		default:
-			// drop message if there are no consumers or if channel buffer is full. wait a little to reduce steal time
-			time.Sleep(100 * time.Millisecond)
-		}
+	point := &streamIngest{
+		IngestPoint: common.IngestPoint{
+			Name: name,
+			Type: common.IngestTLS,
+			Msg:  msg,
+		},
+		out:         out,
+		prefix:      "tlsIngest",
+		addr:        net.JoinHostPort(conf.Bind, strconv.Itoa(conf.Port)),
+		config:      tlsConfig,
+		certs:       certs,
+		allowed:     common.NewAllowList(conf.AllowedCN, conf.AllowedSAN),
+		framing:     framing,
+		connections: metrics.TLSConnections,
+		conns:       make(map[net.Conn]struct{}),
 	}
-}
 
-func (i *tlsIngest) Messages() chan string {
-	return i.Msg
+	return point, nil
 }
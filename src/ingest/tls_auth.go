@@ -0,0 +1,60 @@
+package ingest
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"logbay/common"
+)
+
+// handshake completes TLS handshake and checks client certificate against allow-lists.
+// returns verified client identity to be attached to messages
+func (i *streamIngest) handshake(conn *tls.Conn) (map[string]string, error) {
+
+	// deadline is set under lock so it can't override the one set by Stop
+	i.mu.Lock()
+	if atomic.LoadInt32(&i.stopping) == 0 {
+		conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	}
+	i.mu.Unlock()
+
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	state := conn.ConnectionState()
+
+	return clientIdentity(&state, i.allowed)
+}
+
+// clientIdentity checks client certificate of TLS connection against allow-lists and returns its
+// CN and SANs. connection without verified certificate has no identity
+func clientIdentity(state *tls.ConnectionState, allowed *common.AllowList) (map[string]string, error) {
+
+	if state == nil || len(state.VerifiedChains) == 0 {
+		if allowed != nil {
+			return nil, errors.New("client certificate is required")
+		}
+		return nil, nil
+	}
+
+	cert := state.VerifiedChains[0][0]
+
+	if allowed != nil && !allowed.Permits(cert) {
+		return nil, errors.New(fmt.Sprintf("client %s is not allowed", cert.Subject.CommonName))
+	}
+
+	identity := map[string]string{
+		"tls_cn": cert.Subject.CommonName,
+	}
+
+	if names := common.SubjectAltNames(cert); len(names) > 0 {
+		identity["tls_san"] = strings.Join(names, ",")
+	}
+
+	return identity, nil
+}
@@ -0,0 +1,183 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	random "math/rand"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"logbay/common"
+)
+
+const defaultDatagramSize = 65507
+
+type udpConf struct {
+	Bind      string
+	Port      int
+	MaxSize   int
+	Delimiter byte
+	Buffer    int
+	Overflow  overflowConf
+}
+
+// udpIngest treats every datagram as a single message. trailing delimiter is trimmed.
+// decode, if set, turns datagram into message payload
+type udpIngest struct {
+	common.IngestPoint
+	out       *outbox
+	addr      string
+	maxSize   int
+	delimiter byte
+	decode    func([]byte) []byte
+	conn      net.PacketConn
+	stopping  int32
+	done      chan struct{}
+}
+
+func NewUDPIngest(name string, conf *udpConf) (common.Messenger, error) {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "udpIngest"))
+
+	if conf.Port == 0 {
+		log.Warnf("UDP port should be > 0")
+		return nil, errors.New("invalid port 0")
+	}
+
+	if conf.MaxSize == 0 {
+		log.Debugf("MaxMessageSize is not configured. Using %d", defaultDatagramSize)
+		conf.MaxSize = defaultDatagramSize
+	}
+
+	if conf.Delimiter == 0 {
+		conf.Delimiter = '\n'
+	}
+
+	if len(conf.Bind) == 0 {
+		conf.Bind = "0.0.0.0"
+	}
+
+	if len(name) == 0 {
+		name = fmt.Sprintf("udp-ingest#%d", random.Int())
+	}
+
+	if conf.Buffer == 0 {
+		conf.Buffer = 50
+	}
+
+	msg := make(chan *common.Message, conf.Buffer)
+	out, err := newOutbox(name, msg, &conf.Overflow)
+
+	if err != nil {
+		return nil, err
+	}
+
+	point := &udpIngest{
+		IngestPoint: common.IngestPoint{
+			Name: name,
+			Type: common.IngestUDP,
+			Msg:  msg,
+		},
+		out:       out,
+		addr:      net.JoinHostPort(conf.Bind, strconv.Itoa(conf.Port)),
+		maxSize:   conf.MaxSize,
+		delimiter: conf.Delimiter,
+		done:      make(chan struct{}),
+	}
+
+	return point, nil
+}
+
+func (i *udpIngest) Start() error {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "udpIngest"))
+
+	conn, err := net.ListenPacket("udp", i.addr)
+
+	if err != nil {
+		log.Errorf("Failed to start server. Err: %s", err.Error())
+		return err
+	}
+
+	i.conn = conn
+
+	log.Infof("Listening for incoming UDP datagrams on %s", i.addr)
+
+	go i.read()
+
+	return nil
+}
+
+// Stop closes socket and waits for datagrams read so far to be written
+func (i *udpIngest) Stop(ctx context.Context) error {
+
+	atomic.StoreInt32(&i.stopping, 1)
+
+	if i.conn == nil {
+		return i.out.close(ctx)
+	}
+
+	i.conn.Close()
+
+	select {
+	case <-i.done:
+		return i.out.close(ctx)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (i *udpIngest) read() {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "udpIngest"))
+
+	defer close(i.done)
+
+	// one extra byte tells datagram didn't fit
+	buf := make([]byte, i.maxSize+1)
+
+	for {
+		n, addr, err := i.conn.ReadFrom(buf)
+
+		if err != nil {
+			if atomic.LoadInt32(&i.stopping) == 1 {
+				return
+			}
+
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+
+			log.Errorf("Can't read datagram. Err: %s", err.Error())
+			return
+		}
+
+		if n > i.maxSize {
+			log.Warnf("Datagram from %s exceeds %d bytes. Dropping it", addr, i.maxSize)
+			continue
+		}
+
+		b := bytes.TrimSuffix(buf[:n], []byte{i.delimiter})
+
+		if len(b) == 0 {
+			continue
+		}
+
+		// buffer is reused for the next datagram
+		payload := make([]byte, len(b))
+		copy(payload, b)
+
+		if i.decode != nil {
+			payload = i.decode(payload)
+		}
+
+		i.out.write(common.NewMessage(payload, addr.String()))
+	}
+}
+
+func (i *udpIngest) Messages() chan *common.Message {
+	return i.Msg
+}
@@ -0,0 +1,209 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"logbay/common"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	IngestReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "logbay",
+		Subsystem: "ingest",
+		Name:      "received_total",
+		Help:      "Messages received by ingest point.",
+	}, []string{"ingest"})
+
+	IngestDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "logbay",
+		Subsystem: "ingest",
+		Name:      "dropped_total",
+		Help:      "Messages dropped by ingest point because its buffer was full.",
+	}, []string{"ingest"})
+
+	TLSConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "logbay",
+		Subsystem: "ingest",
+		Name:      "tls_connections",
+		Help:      "Active TLS connections.",
+	}, []string{"ingest"})
+
+	TCPConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "logbay",
+		Subsystem: "ingest",
+		Name:      "tcp_connections",
+		Help:      "Active plain TCP connections.",
+	}, []string{"ingest"})
+
+	DigestReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "logbay",
+		Subsystem: "digest",
+		Name:      "received_total",
+		Help:      "Messages received by digest point.",
+	}, []string{"digest"})
+
+	DigestDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "logbay",
+		Subsystem: "digest",
+		Name:      "dropped_total",
+		Help:      "Messages digest point failed to consume.",
+	}, []string{"digest"})
+
+	WSClients = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "logbay",
+		Subsystem: "digest",
+		Name:      "ws_clients",
+		Help:      "Connected websocket clients.",
+	}, []string{"digest"})
+
+	WSClientDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "logbay",
+		Subsystem: "digest",
+		Name:      "ws_client_dropped_total",
+		Help:      "Messages dropped for websocket clients which don't keep up.",
+	}, []string{"digest"})
+
+	ElasticBulkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "logbay",
+		Subsystem: "digest",
+		Name:      "elastic_bulk_duration_seconds",
+		Help:      "Elasticsearch _bulk request latency.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"digest"})
+
+	ElasticBulkFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "logbay",
+		Subsystem: "digest",
+		Name:      "elastic_bulk_failures_total",
+		Help:      "Failed Elasticsearch _bulk requests.",
+	}, []string{"digest"})
+
+	RedisPublishErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "logbay",
+		Subsystem: "digest",
+		Name:      "redis_publish_errors_total",
+		Help:      "Failed redis publish, xadd and push commands.",
+	}, []string{"digest"})
+)
+
+func init() {
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		IngestReceived,
+		IngestDropped,
+		TLSConnections,
+		TCPConnections,
+		DigestReceived,
+		DigestDropped,
+		WSClients,
+		WSClientDropped,
+		ElasticBulkDuration,
+		ElasticBulkFailures,
+		RedisPublishErrors,
+	)
+}
+
+// RegisterIngestBuffer exposes current length and capacity of ingest point buffer
+func RegisterIngestBuffer(name string, length, capacity func() int) {
+	registerDepth("ingest", "buffer", name, length, capacity)
+}
+
+// RegisterDigestQueue exposes current length and capacity of digest point queue
+func RegisterDigestQueue(name string, length, capacity func() int) {
+	registerDepth("digest", "queue", name, length, capacity)
+}
+
+func registerDepth(kind, metric, name string, length, capacity func() int) {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "metrics"))
+
+	collectors := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   "logbay",
+			Subsystem:   kind,
+			Name:        fmt.Sprintf("%s_length", metric),
+			Help:        fmt.Sprintf("Messages waiting in %s point %s.", kind, metric),
+			ConstLabels: prometheus.Labels{kind: name},
+		}, func() float64 { return float64(length()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   "logbay",
+			Subsystem:   kind,
+			Name:        fmt.Sprintf("%s_capacity", metric),
+			Help:        fmt.Sprintf("Capacity of %s point %s.", kind, metric),
+			ConstLabels: prometheus.Labels{kind: name},
+		}, func() float64 { return float64(capacity()) }),
+	}
+
+	for _, c := range collectors {
+		if err := registry.Register(c); err != nil {
+			log.Warnf("Can't register %s %s metrics for %s. Err: %s", kind, metric, name, err.Error())
+		}
+	}
+}
+
+// Server exposes collected metrics over HTTP
+type Server struct {
+	server *http.Server
+}
+
+func NewServer(conf common.MetricsConfig) *Server {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "metrics"))
+
+	if len(conf.Endpoint) == 0 {
+		log.Debugln("Endpoint is not configured. Using /metrics")
+		conf.Endpoint = "/metrics"
+	}
+
+	if conf.Endpoint[0] != '/' {
+		conf.Endpoint = fmt.Sprintf("/%s", conf.Endpoint)
+	}
+
+	if len(conf.Host) == 0 {
+		conf.Host = "0.0.0.0"
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(conf.Endpoint, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	return &Server{
+		server: &http.Server{
+			Addr:    fmt.Sprintf("%s:%d", conf.Host, conf.Port),
+			Handler: mux,
+		},
+	}
+}
+
+func (s *Server) Start() error {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "metrics"))
+
+	listener, err := net.Listen("tcp", s.server.Addr)
+
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Metrics server stopped. Err: %s", err.Error())
+		}
+	}()
+
+	log.Infof("Serving metrics on %s", s.server.Addr)
+
+	return nil
+}
+
+func (s *Server) Stop(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
@@ -0,0 +1,114 @@
+package router
+
+import (
+	"context"
+	"sync"
+
+	"logbay/common"
+	"logbay/metrics"
+)
+
+const defaultQueueSize = 100
+
+// Router fans out messages from ingest points to consumers. Every consumer has its own bounded queue
+// and worker so a slow consumer doesn't stall others until its queue is full
+type Router struct {
+	queues  map[string]*queue
+	routes  sync.WaitGroup
+	workers sync.WaitGroup
+}
+
+type queue struct {
+	name     string
+	consumer common.Consumer
+	ch       chan *common.Message
+}
+
+func New() *Router {
+	return &Router{
+		queues: make(map[string]*queue),
+	}
+}
+
+// AddConsumer creates consumer queue of given size and starts its worker
+func (r *Router) AddConsumer(name string, consumer common.Consumer, size int) {
+
+	if _, ok := r.queues[name]; ok {
+		return
+	}
+
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+
+	q := &queue{
+		name:     name,
+		consumer: consumer,
+		ch:       make(chan *common.Message, size),
+	}
+
+	r.queues[name] = q
+
+	metrics.RegisterDigestQueue(name,
+		func() int { return len(q.ch) },
+		func() int { return cap(q.ch) },
+	)
+
+	r.workers.Add(1)
+	go r.work(q)
+}
+
+// Route delivers messages of m to named consumers until m closes its channel
+func (r *Router) Route(m common.Messenger, consumers []string) {
+
+	queues := make([]*queue, 0, len(consumers))
+
+	for _, name := range consumers {
+		if q, ok := r.queues[name]; ok {
+			queues = append(queues, q)
+		}
+	}
+
+	r.routes.Add(1)
+	go func() {
+		defer r.routes.Done()
+		for msg := range m.Messages() {
+			msg.Hold(len(queues))
+			for _, q := range queues {
+				q.ch <- msg
+			}
+		}
+	}()
+}
+
+// Drain waits for every routed ingest channel to be closed and for consumers to process their queues.
+// Must be called after ingest points are stopped
+func (r *Router) Drain(ctx context.Context) error {
+
+	if err := common.WaitContext(ctx, &r.routes); err != nil {
+		return err
+	}
+
+	for _, q := range r.queues {
+		close(q.ch)
+	}
+
+	return common.WaitContext(ctx, &r.workers)
+}
+
+func (r *Router) work(q *queue) {
+
+	log := common.ContextLogger(context.WithValue(context.Background(), "prefix", "router"))
+
+	defer r.workers.Done()
+
+	for msg := range q.ch {
+		err := q.consumer.Consume(msg)
+
+		if err != nil {
+			log.Debugf("%s failed to consume message. Err: %s", q.name, err.Error())
+		}
+
+		msg.Release(err == nil)
+	}
+}
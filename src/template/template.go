@@ -0,0 +1,240 @@
+package template
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"logbay/common"
+)
+
+// Template renders strings like "logbay:{{process}}:%Y.%m.%d". {{field}} is substituted with value of
+// message JSON field, nested fields are addressed with dotted path like {{kubernetes.pod}}.
+// {{field|default}} renders default when field can't be resolved. {{@ingest}}, {{@remote}}, {{@seq}}
+// and {{@<meta key>}} are substituted with message envelope values, %-directives with parts of message receive time
+// unless template is compiled with CompileFields
+type Template struct {
+	source string
+	parts  []part
+	fields bool
+}
+
+type part struct {
+	literal    string
+	field      string
+	def        string
+	hasDefault bool
+	verb       byte
+}
+
+// Compile compiles template substituting both fields and %-directives
+func Compile(source string) (*Template, error) {
+	return compile(source, true)
+}
+
+// CompileFields compiles template substituting fields only. % is rendered as is
+func CompileFields(source string) (*Template, error) {
+	return compile(source, false)
+}
+
+func compile(source string, dated bool) (*Template, error) {
+
+	t := &Template{source: source}
+	literal := strings.Builder{}
+
+	flush := func() {
+		if literal.Len() > 0 {
+			t.parts = append(t.parts, part{literal: literal.String()})
+			literal.Reset()
+		}
+	}
+
+	for i := 0; i < len(source); i++ {
+		switch {
+		case strings.HasPrefix(source[i:], "{{"):
+			end := strings.Index(source[i:], "}}")
+
+			if end < 0 {
+				return nil, errors.New(fmt.Sprintf("unclosed {{ at %d in %s", i, source))
+			}
+
+			p := part{field: strings.TrimSpace(source[i+2 : i+end])}
+
+			if pipe := strings.IndexByte(p.field, '|'); pipe >= 0 {
+				p.def = strings.TrimSpace(p.field[pipe+1:])
+				p.field = strings.TrimSpace(p.field[:pipe])
+				p.hasDefault = true
+			}
+
+			if len(p.field) == 0 {
+				return nil, errors.New(fmt.Sprintf("empty field name at %d in %s", i, source))
+			}
+
+			flush()
+			t.parts = append(t.parts, p)
+			t.fields = true
+			i += end + 1
+		case dated && source[i] == '%' && i+1 < len(source):
+			verb := source[i+1]
+
+			if verb == '%' {
+				literal.WriteByte('%')
+			} else if strings.IndexByte("YymdHMSj", verb) >= 0 {
+				flush()
+				t.parts = append(t.parts, part{verb: verb})
+			} else {
+				return nil, errors.New(fmt.Sprintf("unknown directive %%%c in %s", verb, source))
+			}
+
+			i++
+		default:
+			literal.WriteByte(source[i])
+		}
+	}
+
+	flush()
+
+	return t, nil
+}
+
+// Static reports if template renders the same string for every message
+func (t *Template) Static() bool {
+	return len(t.parts) == 0 || (len(t.parts) == 1 && len(t.parts[0].literal) > 0)
+}
+
+func (t *Template) String() string {
+	return t.source
+}
+
+// Execute renders template for msg. Fields missing in msg and having no default are rendered empty
+// and reported with false
+func (t *Template) Execute(msg *common.Message) (string, bool) {
+
+	var doc interface{}
+
+	if t.fields {
+		doc = Decode(msg.Payload)
+	}
+
+	resolved := true
+	result := strings.Builder{}
+
+	for _, p := range t.parts {
+		switch {
+		case len(p.field) > 0:
+			value, ok := Lookup(msg, doc, p.field)
+
+			if !ok && p.hasDefault {
+				value, ok = p.def, true
+			}
+
+			if !ok {
+				resolved = false
+			}
+
+			result.WriteString(value)
+		case p.verb != 0:
+			result.WriteString(strftime(p.verb, msg.ReceivedAt))
+		default:
+			result.WriteString(p.literal)
+		}
+	}
+
+	return result.String(), resolved
+}
+
+// Decode parses JSON payload into document suitable for Lookup. payloads which aren't JSON yield nil
+func Decode(payload []byte) interface{} {
+
+	var doc interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	decoder.Decode(&doc)
+
+	return doc
+}
+
+// Lookup resolves field the way {{field}} is rendered: @-prefixed fields from msg envelope, others
+// by dotted path in doc decoded from msg payload
+func Lookup(msg *common.Message, doc interface{}, field string) (string, bool) {
+
+	if strings.HasPrefix(field, "@") {
+		return envelope(msg, field[1:])
+	}
+
+	return lookup(doc, field)
+}
+
+func envelope(msg *common.Message, field string) (string, bool) {
+
+	switch field {
+	case "ingest":
+		return msg.Ingest, len(msg.Ingest) > 0
+	case "remote":
+		return msg.Remote, len(msg.Remote) > 0
+	case "seq":
+		return strconv.FormatUint(msg.Seq, 10), true
+	}
+
+	value, ok := msg.Meta[field]
+	return value, ok
+}
+
+// lookup finds value by dotted path. JSON numbers are expected to be decoded as json.Number
+func lookup(doc interface{}, path string) (string, bool) {
+
+	value := doc
+
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+
+		if !ok {
+			return "", false
+		}
+
+		if value, ok = object[key]; !ok {
+			return "", false
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+
+	// objects, arrays and nulls can't be rendered
+	return "", false
+}
+
+func strftime(verb byte, ts time.Time) string {
+
+	switch verb {
+	case 'Y':
+		return ts.Format("2006")
+	case 'y':
+		return ts.Format("06")
+	case 'm':
+		return ts.Format("01")
+	case 'd':
+		return ts.Format("02")
+	case 'H':
+		return ts.Format("15")
+	case 'M':
+		return ts.Format("04")
+	case 'S':
+		return ts.Format("05")
+	case 'j':
+		return fmt.Sprintf("%03d", ts.YearDay())
+	}
+
+	return ""
+}
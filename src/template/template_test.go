@@ -0,0 +1,189 @@
+package template
+
+import (
+	"testing"
+	"time"
+
+	"logbay/common"
+)
+
+func TestExecute(t *testing.T) {
+
+	payload := `{
+		"process": "api",
+		"kubernetes": {"pod": "api-1", "labels": {"app": "logbay"}},
+		"status": 503,
+		"latency": 0.25,
+		"id": 12345678901234567890,
+		"ok": false,
+		"tags": ["a", "b"],
+		"empty": "",
+		"missing": null,
+		"pod": "top-level"
+	}`
+
+	msg := common.NewMessage([]byte(payload), "10.0.0.1:514")
+	msg.Ingest = "tls-in"
+	msg.Seq = 42
+	msg.Meta = map[string]string{"tls_cn": "app-1"}
+	msg.ReceivedAt = time.Date(2019, time.February, 3, 4, 5, 6, 0, time.UTC)
+
+	cases := []struct {
+		source   string
+		result   string
+		resolved bool
+	}{
+		{"logbay:{{process}}", "logbay:api", true},
+		{"{{ process }}", "api", true},
+		{"{{kubernetes.pod}}", "api-1", true},
+		{"{{kubernetes.labels.app}}", "logbay", true},
+		{"{{status}}/{{latency}}", "503/0.25", true},
+		{"{{id}}", "12345678901234567890", true},
+		{"{{ok}}", "false", true},
+		{"{{empty}}", "", true},
+		// top-level key of the same name doesn't resolve nested path
+		{"{{kubernetes.labels.pod}}", "", false},
+		{"{{pod}}", "top-level", true},
+		{"{{labels.app}}", "", false},
+		// objects, arrays and nulls can't be rendered
+		{"{{kubernetes}}", "", false},
+		{"{{tags}}", "", false},
+		{"{{missing}}", "", false},
+		{"{{process.name}}", "", false},
+		{"{{unknown}}", "", false},
+		{"{{unknown|n/a}}", "n/a", true},
+		{"{{ unknown | n/a }}", "n/a", true},
+		{"{{unknown|}}", "", true},
+		{"{{process|n/a}}", "api", true},
+		{"{{missing|none}}", "none", true},
+		{"{{@ingest}}:{{@remote}}:{{@seq}}", "tls-in:10.0.0.1:514:42", true},
+		{"{{@tls_cn}}", "app-1", true},
+		{"{{@tls_san}}", "", false},
+		{"{{@tls_san|anonymous}}", "anonymous", true},
+		{"logs-%Y.%m.%d", "logs-2019.02.03", true},
+		{"%y%j-%H:%M:%S", "19034-04:05:06", true},
+		{"100%%-%Y", "100%-2019", true},
+		{"%%Y", "%Y", true},
+		{"trailing %", "trailing %", true},
+		{"{{process}}-%Y", "api-2019", true},
+	}
+
+	for _, c := range cases {
+		tmpl, err := Compile(c.source)
+
+		if err != nil {
+			t.Errorf("Can't compile %s. Err: %s", c.source, err.Error())
+			continue
+		}
+
+		result, resolved := tmpl.Execute(msg)
+
+		if result != c.result || resolved != c.resolved {
+			t.Errorf("Unexpected result of %s: %q, %v", c.source, result, resolved)
+		}
+	}
+}
+
+func TestExecuteWhitespace(t *testing.T) {
+
+	tmpl, _ := Compile("{{process}}:{{kubernetes.pod}}:{{count}}")
+
+	payloads := []string{
+		`{"process":"api","kubernetes":{"pod":"api-1"},"count":3}`,
+		`{"process" : "api", "kubernetes" : { "pod" :	"api-1" }, "count" : 3}`,
+		"{\n  \"process\": \"api\",\n  \"kubernetes\": {\n    \"pod\": \"api-1\"\n  },\n  \"count\": 3\n}",
+	}
+
+	for _, payload := range payloads {
+		result, resolved := tmpl.Execute(common.NewMessage([]byte(payload), ""))
+
+		if result != "api:api-1:3" || !resolved {
+			t.Errorf("Unexpected result for %s: %q, %v", payload, result, resolved)
+		}
+	}
+}
+
+func TestExecuteNonJSON(t *testing.T) {
+
+	msg := common.NewMessage([]byte(`process="api" status=503`), "")
+	msg.Ingest = "udp-in"
+
+	tmpl, _ := Compile("{{@ingest}}:{{process|unknown}}")
+
+	if result, resolved := tmpl.Execute(msg); result != "udp-in:unknown" || !resolved {
+		t.Errorf("Unexpected result %q, %v", result, resolved)
+	}
+}
+
+func TestCompileFields(t *testing.T) {
+
+	msg := common.NewMessage([]byte(`{"process":"api"}`), "")
+	msg.ReceivedAt = time.Date(2019, time.February, 3, 4, 5, 6, 0, time.UTC)
+
+	cases := []struct {
+		source string
+		result string
+	}{
+		{"logbay:{{process}}:%Y", "logbay:api:%Y"},
+		{"100%%", "100%%"},
+		{"%q%", "%q%"},
+		{"%{{process}}%", "%api%"},
+	}
+
+	for _, c := range cases {
+		tmpl, err := CompileFields(c.source)
+
+		if err != nil {
+			t.Errorf("Can't compile %s. Err: %s", c.source, err.Error())
+			continue
+		}
+
+		if result, _ := tmpl.Execute(msg); result != c.result {
+			t.Errorf("Unexpected result of %s: %q", c.source, result)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+
+	sources := []string{
+		"logbay:{{process",
+		"{{}}",
+		"{{ |default}}",
+		"logs-%Q",
+		"%z",
+	}
+
+	for _, source := range sources {
+		if _, err := Compile(source); err == nil {
+			t.Errorf("Expected %s not to compile", source)
+		}
+	}
+
+	// unknown directives are literal when only fields are substituted
+	if _, err := CompileFields("logs-%Q"); err != nil {
+		t.Errorf("Expected %% to be literal. Err: %s", err.Error())
+	}
+}
+
+func TestStatic(t *testing.T) {
+
+	cases := []struct {
+		source string
+		static bool
+	}{
+		{"", true},
+		{"logbay:entry", true},
+		{"100%%", true},
+		{"logbay:{{process}}", false},
+		{"logs-%Y", false},
+	}
+
+	for _, c := range cases {
+		tmpl, _ := Compile(c.source)
+
+		if tmpl.Static() != c.static {
+			t.Errorf("Unexpected Static of %q: %v", c.source, tmpl.Static())
+		}
+	}
+}